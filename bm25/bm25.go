@@ -4,23 +4,21 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
-	"log"
-	"math"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"sync"
 
-	"github.com/deanrtaylor1/gosearch/lexer"
 	"github.com/deanrtaylor1/gosearch/logger"
+	"github.com/deanrtaylor1/gosearch/query"
 	"github.com/deanrtaylor1/gosearch/util"
 )
 
 const (
-	k1 = 1.2
-	b  = 0.75
+	//proximityWeight scales the boost given to documents matching a phrase or proximity query
+	proximityWeight = 1.0
 )
 
 type TermFreq map[string]int
@@ -30,18 +28,52 @@ type DocFreq = map[string]int
 type DocData struct {
 	TermCount int
 	Terms     TermFreq
+	//FieldLengths is the number of terms in each field of the document
+	FieldLengths [NumFields]int
 }
 
+// Posting records how often and where a term occurs in a single document
+type Posting struct {
+	Freq int
+	//Positions are the ascending token offsets of the term, used for phrase and proximity queries
+	Positions []int
+	//FieldFreqs is how often the term occurs in each field
+	FieldFreqs [NumFields]int
+}
+
+// PostingsList maps the documents (keyed by path) containing a term to their posting
+type PostingsList map[string]Posting
+
+// InvertedIndex maps every term to the postings list of documents that contain it
+type InvertedIndex map[string]PostingsList
+
 type Model struct {
 	Name string
 	TFPD TermFreqPerDoc
 	//DF is the Document Frequency of a term
 	DF DocFreq
+	//Postings is the inverted index used to only score documents containing a query term
+	Postings InvertedIndex
 	//DA is the average document length
-	DA              float32
-	TermCount       int
-	DocCount        int
-	DirLength       float32
+	DA float32
+	//FieldLengths is the total number of terms in each field across all documents
+	FieldLengths [NumFields]int
+	//Ranking is the bm25 configuration of the index, used when a search doesn't set its own
+	Ranking   RankingConfig
+	TermCount int
+	DocCount  int
+	DirLength float32
+	//Documents is the stored text of each document, used to build result snippets. It is only filled when the
+	//documents aren't streamed to segments
+	Documents map[string]util.IndexedData
+	//DocStore reads the stored text of a loaded index from its segments when it isn't in Documents
+	DocStore *SegmentStore
+	//DocWriter is the writer of the crawl in progress, the pages it has stored are read from it
+	DocWriter DocumentWriter
+	//Pages holds the validators and links of each crawled page, used by incremental re-crawls
+	Pages map[string]PageMeta
+	//Outcomes records what happened to each url of the last crawl, whether it was indexed or why not
+	Outcomes        map[string]PageOutcome
 	UrlFiles        map[string]string
 	ReverseUrlFiles map[string]string
 	ModelLock       *sync.Mutex
@@ -49,14 +81,22 @@ type Model struct {
 }
 
 type ResultsMap struct {
-	Name string  `json:"name"`
-	Path string  `json:"path"`
-	TF   float32 `json:"tf"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	TF       float32   `json:"tf"`
+	Snippets []Snippet `json:"snippets,omitempty"`
+	//Explanation is only set when the search was run with SearchOptions.Explain
+	Explanation *Explanation `json:"explanation,omitempty"`
 }
 
 type FileOps interface {
 	MkdirAll(dirName string, perm os.FileMode) error
 	CompressAndWriteGzipFile(filename string, data interface{}, dirName string) error
+	WriteJSONFile(filename string, data interface{}, dirName string) error
+	WriteManifest(manifest Manifest, dirName string) error
+	CommitGeneration(dirName string, generation string) error
+	RemoveFile(filename string, dirName string) error
+	CreateDocumentWriter(dirName string) (DocumentWriter, error)
 }
 
 type FileOpsImpl struct{}
@@ -69,6 +109,32 @@ func (f FileOpsImpl) CompressAndWriteGzipFile(filename string, data interface{},
 	return CompressAndWriteGzipFile(filename, data, dirName)
 }
 
+func (f FileOpsImpl) WriteJSONFile(filename string, data interface{}, dirName string) error {
+	return WriteJSONFile(filename, data, dirName)
+}
+
+func (f FileOpsImpl) WriteManifest(manifest Manifest, dirName string) error {
+	return WriteManifest(manifest, dirName)
+}
+
+func (f FileOpsImpl) CommitGeneration(dirName string, generation string) error {
+	return CommitGeneration(dirName, generation)
+}
+
+// This function removes a file from an index directory, a file that doesn't exist isn't an error
+func (f FileOpsImpl) RemoveFile(filename string, dirName string) error {
+	if err := os.Remove(path.Join(dirName, filename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// This function returns a writer for the stored documents of a generation, a generation resumed from a checkpoint
+// continues its segments
+func (f FileOpsImpl) CreateDocumentWriter(dirName string) (DocumentWriter, error) {
+	return OpenSegmentWriter(dirName, DefaultSegmentSize)
+}
+
 type FileOpsNoOp struct{}
 
 func (f FileOpsNoOp) MkdirAll(dirName string, perm os.FileMode) error {
@@ -79,33 +145,48 @@ func (f FileOpsNoOp) CompressAndWriteGzipFile(filename string, data interface{},
 	return nil
 }
 
-// This function is used to convert html string content (or any string) to a model as defined above
-func ConvertContentToModel(content string, path string, model *Model) {
-	tf := make(TermFreq)
+func (f FileOpsNoOp) WriteJSONFile(filename string, data interface{}, dirName string) error {
+	return nil
+}
 
-	lexer := lexer.NewLexer(content)
+func (f FileOpsNoOp) WriteManifest(manifest Manifest, dirName string) error {
+	return nil
+}
 
-	for {
-		token, err := lexer.Next()
-		if err != nil {
-			//log.Println("EOF")
-			break
-		}
+func (f FileOpsNoOp) CommitGeneration(dirName string, generation string) error {
+	return nil
+}
 
-		tf[token] += 1
-	}
-	model.ModelLock.Lock()
+func (f FileOpsNoOp) RemoveFile(filename string, dirName string) error {
+	return nil
+}
+
+func (f FileOpsNoOp) CreateDocumentWriter(dirName string) (DocumentWriter, error) {
+	return noOpDocumentWriter{}, nil
+}
+
+// This function is used to convert html string content (or any string) to a model as defined above,
+// the content is indexed as the body of the document
+func ConvertContentToModel(content string, path string, model *Model) {
+	var fields [NumFields]string
+	fields[FieldBody] = content
+	indexFields(path, fields, model)
 
-	for token := range tf {
-		model.TermCount += 1
-		model.DF[token] += 1
-	}
-	model.ModelLock.Unlock()
 	model.ModelLock.Lock()
-	model.TFPD[path] = ConvertToDocData(tf)
+	model.Documents[path] = util.IndexedData{URL: path, Content: content}
 	model.ModelLock.Unlock()
 }
 
+// This function adds a document to the postings list of a term, creating the list if needed
+func addPosting(index InvertedIndex, token string, path string, posting Posting) {
+	postings, ok := index[token]
+	if !ok {
+		postings = make(PostingsList)
+		index[token] = postings
+	}
+	postings[path] = posting
+}
+
 // This function is a utility function to filter out the bm25 results based on a predicate
 func FilterResults(results []ResultsMap, filter func(float32) bool) []ResultsMap {
 	var filteredResults []ResultsMap
@@ -126,32 +207,62 @@ func ResetResultsMap(result []ResultsMap) []ResultsMap {
 }
 
 // This function is used to convert the bm25 for a specific query
-func CalculateBm25(model *Model, query string) ([]ResultsMap, int) {
-	var result []ResultsMap
-
-	count := 0
+// only the documents found in the postings of a query term are scored and only the requested page is ranked
+func CalculateBm25(model *Model, q query.Node, opts SearchOptions) SearchResults {
 	model.ModelLock.Lock()
 	defer model.ModelLock.Unlock()
 
-	for path, table := range model.TFPD {
-		//log.Println(path)
-		querylexer := lexer.NewLexer(string(query))
-		var rank float32 = 0
-		for {
-			token, err := querylexer.Next()
-			if err != nil {
-				break
-			}
-			rank += ComputeTF(token, table.TermCount, table.Terms, model.DA) * ComputeIDF(token, len(model.TFPD), model.DF)
-			count += 1
-		}
-		result = append(result, ResultsMap{model.UrlFiles[path], path, rank})
-		sort.Slice(result, func(i, j int) bool {
-			return result[i].TF > result[j].TF
-		})
+	ranking := model.Ranking
+	if opts.Ranking != nil {
+		ranking = *opts.Ranking
+	}
+
+	scorer := &bm25Scorer{model: model, ranking: ranking, averages: averageFieldLengths(model)}
+	scores := query.Evaluate(q, scorer)
 
+	results := TopResults(scores, model.UrlFiles, scorer.count, opts)
+	if opts.Explain {
+		explainBm25(model, results.Results, q, ranking, scorer.averages)
 	}
-	return result, count
+	return results
+}
+
+// bm25Scorer ranks the terms and phrases of a query AST with BM25F, count is the number of postings scored
+type bm25Scorer struct {
+	model    *Model
+	ranking  RankingConfig
+	averages [NumFields]float32
+	count    int
+}
+
+func (s *bm25Scorer) ScoreTerm(term string) map[string]float32 {
+	scores := make(map[string]float32)
+	idf := s.ranking.IDF(term, len(s.model.TFPD), s.model.DF)
+	for path, posting := range s.model.Postings[term] {
+		scores[path] = s.ranking.ComputeBM25F(posting, s.model.TFPD[path], s.averages) * idf
+		s.count += 1
+	}
+	return scores
+}
+
+// Phrases only score documents where the phrase (or a proximity match for "phrase"~N) occurs,
+// the sum of the term scores is boosted by the sloppy phrase frequency normalised by the document's total length
+func (s *bm25Scorer) ScorePhrase(phrase query.Phrase) map[string]float32 {
+	scores := make(map[string]float32)
+	var idf float32
+	for _, token := range phrase.Terms {
+		idf += s.ranking.IDF(token, len(s.model.TFPD), s.model.DF)
+	}
+
+	for path, phraseFreq := range MatchPhrase(s.model, phrase) {
+		doc := s.model.TFPD[path]
+		for _, token := range phrase.Terms {
+			scores[path] += s.ranking.ComputeBM25F(s.model.Postings[token][path], doc, s.averages) * s.ranking.IDF(token, len(s.model.TFPD), s.model.DF)
+			s.count += 1
+		}
+		scores[path] += proximityWeight * s.ranking.TF(phraseFreq, doc.TermCount, averageDocLength(s.averages)) * idf
+	}
+	return scores
 }
 
 // This is used to reset the model before indexing a new dataset
@@ -160,28 +271,65 @@ func ResetModel(model *Model) {
 	defer model.ModelLock.Unlock()
 	model.TFPD = make(map[string]DocData)
 	model.DF = make(map[string]int)
+	model.Postings = make(InvertedIndex)
+	model.Documents = make(map[string]util.IndexedData)
+	model.DocStore = nil
+	model.DocWriter = nil
+	model.Pages = make(map[string]PageMeta)
+	model.Outcomes = make(map[string]PageOutcome)
 	model.UrlFiles = make(map[string]string)
 	model.ReverseUrlFiles = make(map[string]string)
 	model.DocCount = 0
 	model.TermCount = 0
 	model.DirLength = 0
 	model.DA = 0
+	model.FieldLengths = [NumFields]int{}
+	model.Ranking = DefaultRankingConfig
 	model.Name = ""
 	model.IsComplete = false
 }
 
+// This function replaces everything in the model with the contents of another model in one update, the model keeps
+// its own lock so code holding it sees either the old or the new index
+func ReplaceModel(model *Model, replacement *Model) {
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+	lock := model.ModelLock
+	*model = *replacement
+	model.ModelLock = lock
+}
+
 // This function returns a new bm25 model
 func NewEmptyModel() *Model {
 	return &Model{
 		TFPD:            make(map[string]DocData),
 		DF:              make(map[string]int),
+		Postings:        make(InvertedIndex),
+		Documents:       make(map[string]util.IndexedData),
+		Pages:           make(map[string]PageMeta),
+		Outcomes:        make(map[string]PageOutcome),
 		UrlFiles:        make(map[string]string),
 		ReverseUrlFiles: make(map[string]string),
+		Ranking:         DefaultRankingConfig,
 		ModelLock:       &sync.Mutex{},
 	}
 }
 
-// This function is used to write and compress a datastructure to disk
+// This function is used to write a datastructure to disk as indented json, for files meant to be read or edited by people
+func WriteJSONFile(fileName string, data interface{}, dirName string) error {
+	jsonBytes, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", fileName, err)
+	}
+
+	if err := writeFileAtomic(path.Join(dirName, fileName), jsonBytes, 0644); err != nil {
+		return fmt.Errorf("error writing %s to disk: %v", fileName, err)
+	}
+
+	return nil
+}
+
+// This function is used to write and compress a datastructure to disk, the file is replaced atomically
 func CompressAndWriteGzipFile(fileName string, data interface{}, dirName string) error {
 	var compressedData bytes.Buffer
 	gzipWriter := gzip.NewWriter(&compressedData)
@@ -195,38 +343,28 @@ func CompressAndWriteGzipFile(fileName string, data interface{}, dirName string)
 		return fmt.Errorf("error closing gzip writer: %v", err)
 	}
 
-	if err := os.WriteFile(path.Join(dirName, fileName), compressedData.Bytes(), 0644); err != nil {
+	if err := writeFileAtomic(path.Join(dirName, fileName), compressedData.Bytes(), 0644); err != nil {
 		return fmt.Errorf("error writing compressed data to disk: %v", err)
 	}
 
 	return nil
 }
 
+// This function reads a file written by CompressAndWriteGzipFile into data
+func ReadGzipFile(fileName string, data interface{}, dirName string) error {
+	return readGzipGob(path.Join(dirName, fileName), data)
+}
+
 // Utility predicate function to check if a float32 is greater than 0
 func IsGreaterThanZero(value float32) bool {
 	return value > 0
 }
 
 // This function is used to read and decompress a datastructure from disk
-func readUrlFiles(dirPath string, fileName string, model *Model, reverse bool) {
-	compressedData, err := os.ReadFile(dirPath + "/" + fileName)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	gzipReader, err := gzip.NewReader(bytes.NewReader(compressedData))
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	decoder := gob.NewDecoder(gzipReader)
-	gzipReader.Close()
+func readUrlFiles(dirPath string, fileName string, model *Model, reverse bool) error {
 	var decompressedURLFiles map[string]string
-	if err := decoder.Decode(&decompressedURLFiles); err != nil {
-		log.Println(err)
-		return
+	if err := readGzipGob(path.Join(dirPath, fileName), &decompressedURLFiles); err != nil {
+		return err
 	}
 	model.ModelLock.Lock()
 	if reverse {
@@ -235,29 +373,14 @@ func readUrlFiles(dirPath string, fileName string, model *Model, reverse bool) {
 		model.UrlFiles = decompressedURLFiles
 	}
 	model.ModelLock.Unlock()
-
+	return nil
 }
 
-// This function is used to read and decompress a TermFreq from disk
-func readCompressedFilesToModel(dirPath string, fileName string, model *Model) {
-	compressedData, err := os.ReadFile(dirPath + "/" + fileName)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	gzipReader, err := gzip.NewReader(bytes.NewReader(compressedData))
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	decoder := gob.NewDecoder(gzipReader)
-	gzipReader.Close()
+// This function is used to read and decompress the raw content of an older index and index every document again
+func readCompressedFilesToModel(dirPath string, fileName string, model *Model) error {
 	var decompressedDataMap map[string]util.IndexedData
-	if err := decoder.Decode(&decompressedDataMap); err != nil {
-		log.Println(err)
-		return
+	if err := readGzipGob(path.Join(dirPath, fileName), &decompressedDataMap); err != nil {
+		return err
 	}
 	model.ModelLock.Lock()
 	model.DirLength += float32(len(decompressedDataMap))
@@ -267,47 +390,138 @@ func readCompressedFilesToModel(dirPath string, fileName string, model *Model) {
 		model.ModelLock.Lock()
 		model.DocCount += 1
 		model.ModelLock.Unlock()
-		content := v.Content
-		ConvertContentToModel(content, filePath, model)
+		v.URL = filePath
+		IndexDocument(v, model)
 	}
+	return nil
 }
 
-// This function is used to load a cached model from disk it handles the different types and redirects to the correct function
-func LoadCachedGobToModel(dirPath string, model *Model) {
-	//log.Println(dirPath)
-	dir, err := os.Open(dirPath)
+// This function is used to load a cached model from disk it handles the different types and redirects to the correct function.
+// The current generation is verified against its manifest and loaded into a separate model first, so on error the model is left untouched
+func LoadCachedGobToModel(dirPath string, model *Model) error {
+	generationDir, err := ResolveIndexDir(dirPath)
+	if err != nil {
+		return fmt.Errorf("error loading index %s: %v", dirPath, err)
+	}
+
+	manifest, err := ReadManifest(generationDir)
+	if err != nil {
+		return fmt.Errorf("error loading index %s: %v", dirPath, err)
+	}
+	if manifest != nil {
+		if err := manifest.Verify(generationDir); err != nil {
+			return fmt.Errorf("error loading index %s: %v", dirPath, err)
+		}
+	}
+
+	loaded, err := loadIndexDir(generationDir, manifest)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error loading index %s: %v", dirPath, err)
 	}
-	defer dir.Close()
 
-	fileInfos, err := dir.Readdir(-1)
+	model.ModelLock.Lock()
+	model.TFPD = loaded.TFPD
+	model.DF = loaded.DF
+	model.Postings = loaded.Postings
+	model.Documents = loaded.Documents
+	model.DocStore = loaded.DocStore
+	model.Pages = loaded.Pages
+	model.Outcomes = loaded.Outcomes
+	model.UrlFiles = loaded.UrlFiles
+	model.ReverseUrlFiles = loaded.ReverseUrlFiles
+	model.FieldLengths = loaded.FieldLengths
+	model.Ranking = loaded.Ranking
+	model.TermCount = loaded.TermCount
+	model.DocCount = loaded.DocCount
+	model.DirLength = loaded.DirLength
+	model.ModelLock.Unlock()
+
+	logger.HandleLog(fmt.Sprintf("\n------------------\n%sFINISHED LOADING MODEL%s\n------------------\n", util.TerminalGreen, util.TerminalReset))
+	return nil
+}
+
+// This function reads every file of an index directory into a new model
+func loadIndexDir(dirPath string, manifest *Manifest) (*Model, error) {
+	fileInfos, err := os.ReadDir(dirPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
+	model := NewEmptyModel()
 	for _, fi := range fileInfos {
-		done := map[string]bool{}
-		if fi.Name() == "url-files.gz" {
-			readUrlFiles(dirPath, fi.Name(), model, false)
-			done[fi.Name()] = true
+		switch fi.Name() {
+		case UrlFilesFileName:
+			err = readUrlFiles(dirPath, fi.Name(), model, false)
+		case ReverseUrlFilesFileName:
+			err = readUrlFiles(dirPath, fi.Name(), model, true)
+		}
+		if err != nil {
+			return nil, err
 		}
-		if fi.Name() == "reverse-url-files.gz" {
-			readUrlFiles(dirPath, fi.Name(), model, true)
-			done[fi.Name()] = true
+	}
+
+	if err := readRankingConfig(dirPath, model); err != nil {
+		return nil, err
+	}
+	if err := readCrawlReport(dirPath, model); err != nil {
+		return nil, err
+	}
+
+	_, segmentsErr := os.Stat(path.Join(dirPath, SegmentIndexFileName))
+	hasSegments := segmentsErr == nil
+
+	//Indexes with a computed index are decoded, the raw content is only needed for snippets
+	if _, err := os.Stat(path.Join(dirPath, IndexFileName)); err == nil {
+		if err := readIndexFile(dirPath, model); err != nil {
+			return nil, err
 		}
-		if done["url-files.gz"] && done["reverse-url-files.gz"] {
-			break
+		if hasSegments {
+			//Segments are read on demand rather than holding every page in memory
+			if model.DocStore, err = OpenSegmentStore(dirPath); err != nil {
+				return nil, err
+			}
+		} else if err := readDocumentsFile(dirPath, model); err != nil && !os.IsNotExist(err) {
+			return nil, err
 		}
+		if manifest != nil && (model.DocCount != manifest.DocCount || model.TermCount != manifest.TermCount) {
+			return nil, fmt.Errorf("%s has %d documents and %d terms, the manifest expects %d and %d",
+				IndexFileName, model.DocCount, model.TermCount, manifest.DocCount, manifest.TermCount)
+		}
+		return model, nil
 	}
 
+	//Without a computed index the segments are streamed in parallel and every document is indexed again,
+	//the content stays in the segments
+	if hasSegments {
+		files, err := segmentFiles(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		if model.DocStore, err = OpenSegmentStore(dirPath); err != nil {
+			return nil, err
+		}
+		err = ReadSegments(dirPath, files, func(doc util.IndexedData) {
+			IndexDocument(doc, model)
+			model.ModelLock.Lock()
+			model.DocCount += 1
+			model.DirLength += 1
+			model.ModelLock.Unlock()
+		})
+		if err != nil {
+			return nil, err
+		}
+		return model, nil
+	}
+
+	//Older indexes only store the raw content so every document is indexed again
 	for _, fi := range fileInfos {
-		if filepath.Ext(fi.Name()) == ".gz" && fi.Name() != "url-files.gz" && fi.Name() != "reverse-url-files.gz" {
-			readCompressedFilesToModel(dirPath, fi.Name(), model)
-			continue
+		if filepath.Ext(fi.Name()) == ".gz" && fi.Name() != UrlFilesFileName && fi.Name() != ReverseUrlFilesFileName {
+			if err := readCompressedFilesToModel(dirPath, fi.Name(), model); err != nil {
+				return nil, err
+			}
 		}
 	}
-	logger.HandleLog(fmt.Sprintf("\n------------------\n%sFINISHED LOADING MODEL%s\n------------------\n", util.TerminalGreen, util.TerminalReset))
+	return model, nil
 }
 
 // This function converts the the TermFreq to a DocData struct which includes the termfreq and the
@@ -335,10 +549,7 @@ func ComputeTF(t string, n int, d TermFreq, DA float32) float32 {
 	//da is the average document length found in the model
 
 	if _, ok := d[t]; ok {
-		M := float32(d[t]) * (k1 + 1)
-		N := float32(d[t]) + (k1 * (1 - b + (b * (float32(n) / DA))))
-
-		return float32(M) / float32(N)
+		return DefaultRankingConfig.TF(float32(d[t]), n, DA)
 	}
 	return 0
 }
@@ -348,16 +559,7 @@ func ComputeIDF(t string, N int, df DocFreq) float32 {
 	//N The total number of documents in the collection.
 
 	//df The number of documents in the collection that contain the term.
-	//log.Println(df[t])
-
-	M := float64(df[t]) + 0.5
-
-	n := math.Max(float64(N)-float64(df[t])+0.5, M)
-	// log.Println(M, n, N)
-	//If M is 0, set it to 1 to avoid division by zero errors.
-
-	//using the log10 function to make the IDF values more readable
 
-	//Calculate the IDF using the formula log(N/M), where N is the total number of documents in the collection and M is the number of documents that contain the term t.
-	return float32(math.Log10(n / M))
+	//using the log10 function to make the IDF values more readable, see RankingConfig.IDF for the formula of each variant
+	return DefaultRankingConfig.IDF(t, N, df)
 }
@@ -4,7 +4,13 @@ import (
 	"math"
 	"os"
 	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/deanrtaylor1/gosearch/query"
+	"github.com/deanrtaylor1/gosearch/util"
 )
 
 type TestData struct {
@@ -121,18 +127,140 @@ func TestResetResultsMap(t *testing.T) {
 func TestCalculateBm25(t *testing.T) {
 	model := NewEmptyModel()
 
-	LoadCachedGobToModel("../test-data/javascript.info", model)
+	if err := LoadCachedGobToModel("../test-data/javascript.info", model); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+
+	results := CalculateBm25(model, query.Term{Value: "javascript"}, SearchOptions{K: 20})
+
+	if results.Count < 1 {
+		t.Errorf("CalculateBm25().Count == %d, want greater than 1", results.Count)
+	}
+
+	if len(results.Results) != 20 {
+		t.Errorf("CalculateBm25().len(Results) == %d, want a page of 20", len(results.Results))
+	}
+
+	if results.Total != len(model.Postings["javascript"]) {
+		t.Errorf("CalculateBm25().Total == %d, want %d documents from the postings", results.Total, len(model.Postings["javascript"]))
+	}
+
+	if results.Results[0].TF != results.MaxScore {
+		t.Errorf("CalculateBm25().Results[0].TF == %f, want MaxScore %f", results.Results[0].TF, results.MaxScore)
+	}
+
+	nextPage := CalculateBm25(model, query.Term{Value: "javascript"}, SearchOptions{K: 20, Offset: 20})
+
+	if len(nextPage.Results) > 0 && nextPage.Results[0].TF > results.Results[19].TF {
+		t.Errorf("CalculateBm25() second page starts at %f, want at most %f", nextPage.Results[0].TF, results.Results[19].TF)
+	}
+
+	results = CalculateBm25(model, query.Term{Value: "qwertyuiopzxcvbnm"}, SearchOptions{K: 20})
+
+	if len(results.Results) != 0 || results.Count != 0 || results.Total != 0 {
+		t.Errorf("CalculateBm25() with unknown term == %d results and count %d, want 0", len(results.Results), results.Count)
+	}
+
+}
+
+func TestTopResults(t *testing.T) {
+	scores := map[string]float32{"a": 1, "b": 5, "c": 3, "d": 4, "e": 2, "f": 3}
+
+	testCases := []struct {
+		name     string
+		opts     SearchOptions
+		expected []string
+	}{
+		{name: "First page", opts: SearchOptions{K: 3}, expected: []string{"b", "d", "c"}},
+		{name: "Second page", opts: SearchOptions{K: 3, Offset: 3}, expected: []string{"f", "e", "a"}},
+		{name: "Past the end", opts: SearchOptions{K: 3, Offset: 10}, expected: []string{}},
+		{name: "No limit", opts: SearchOptions{}, expected: []string{"b", "d", "c", "f", "e", "a"}},
+		{name: "Huge offset", opts: SearchOptions{K: 3, Offset: 1 << 62}, expected: []string{}},
+		{name: "Offset at max int", opts: SearchOptions{K: 3, Offset: math.MaxInt}, expected: []string{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			results := TopResults(scores, map[string]string{}, 0, tc.opts)
+			paths := []string{}
+			for _, r := range results.Results {
+				paths = append(paths, r.Path)
+			}
+			if !reflect.DeepEqual(paths, tc.expected) {
+				t.Errorf("Expected: %v, got: %v", tc.expected, paths)
+			}
+			if results.Total != len(scores) || results.MaxScore != 5 {
+				t.Errorf("Expected total %d and max score 5, got %d and %f", len(scores), results.Total, results.MaxScore)
+			}
+		})
+	}
+}
+
+func TestConvertContentToModel(t *testing.T) {
+	model := NewEmptyModel()
+
+	ConvertContentToModel("apple banana apple", "/fruit", model)
+	ConvertContentToModel("banana cherry", "/more-fruit", model)
+
+	if model.Postings["appl"]["/fruit"].Freq != 2 {
+		t.Errorf("Postings[appl][/fruit].Freq == %d, want 2", model.Postings["appl"]["/fruit"].Freq)
+	}
+
+	if len(model.Postings["banana"]) != 2 {
+		t.Errorf("len(Postings[banana]) == %d, want 2", len(model.Postings["banana"]))
+	}
+
+	if _, ok := model.Postings["cherri"]["/fruit"]; ok {
+		t.Errorf("Postings[cherri] contains /fruit, want only /more-fruit")
+	}
+
+	if model.DF["banana"] != 2 {
+		t.Errorf("DF[banana] == %d, want 2", model.DF["banana"])
+	}
+
+	if !reflect.DeepEqual(model.Postings["appl"]["/fruit"].Positions, []int{0, 2}) {
+		t.Errorf("Postings[appl][/fruit].Positions == %v, want [0 2]", model.Postings["appl"]["/fruit"].Positions)
+	}
+}
+
+func TestMatchPhrase(t *testing.T) {
+	model := NewEmptyModel()
+
+	ConvertContentToModel("promise chaining is easy", "/exact", model)
+	ConvertContentToModel("chaining a promise", "/reversed", model)
+	ConvertContentToModel("a promise is not always worth chaining together", "/apart", model)
 
-	result, count := CalculateBm25(model, "javascript")
+	exact := MatchPhrase(model, query.Phrase{Terms: []string{"promis", "chain"}})
+	if len(exact) != 1 || exact["/exact"] != 1 {
+		t.Errorf("MatchPhrase() exact == %v, want only /exact with frequency 1", exact)
+	}
 
-	if count < 1 {
-		t.Errorf("CalculateBm25().count == %d, want greater than 1", count)
+	sloppy := MatchPhrase(model, query.Phrase{Terms: []string{"promis", "chain"}, Slop: 5})
+	if len(sloppy) != 3 {
+		t.Errorf("MatchPhrase() with slop 5 == %v, want all 3 documents", sloppy)
 	}
+	if sloppy["/exact"] <= sloppy["/reversed"] || sloppy["/reversed"] <= sloppy["/apart"] {
+		t.Errorf("MatchPhrase() with slop 5 == %v, want closer matches to have a higher frequency", sloppy)
+	}
+	model.DA = float32(model.TermCount) / float32(len(model.TFPD))
 
-	if len(result) == 0 {
-		t.Errorf("CalculateBm25().len(result) == 0, want non-zero")
+	q, err := query.Parse(`"promise chaining"`)
+	if err != nil {
+		t.Fatalf("query.Parse() returned %v", err)
+	}
+	results := CalculateBm25(model, q, SearchOptions{K: 10})
+	if results.Total != 1 || results.Results[0].Path != "/exact" {
+		t.Errorf("CalculateBm25() with phrase == %v, want only /exact", results.Results)
 	}
 
+	q, err = query.Parse(`promise -"promise chaining"`)
+	if err != nil {
+		t.Fatalf("query.Parse() returned %v", err)
+	}
+	results = CalculateBm25(model, q, SearchOptions{K: 10})
+	if results.Total != 2 {
+		t.Errorf("CalculateBm25() excluding phrase == %v, want /reversed and /apart", results.Results)
+	}
 }
 
 func TestNewEmptyModel(t *testing.T) {
@@ -175,6 +303,7 @@ func TestResetModel(t *testing.T) {
 	}
 
 	model.DF["test"] = 1
+	model.Postings["test"] = PostingsList{"test": {Freq: 1}}
 	model.UrlFiles["test"] = "test"
 
 	ResetModel(model)
@@ -211,6 +340,10 @@ func TestResetModel(t *testing.T) {
 		t.Errorf("ResetModel().DF == %d, want 0", len(model.DF))
 	}
 
+	if len(model.Postings) != 0 {
+		t.Errorf("ResetModel().Postings == %d, want 0", len(model.Postings))
+	}
+
 	if len(model.UrlFiles) != 0 {
 		t.Errorf("ResetModel().UrlFiles == %d, want 0", len(model.UrlFiles))
 	}
@@ -250,7 +383,9 @@ func TestReadCompressedFilesToModel(t *testing.T) {
 func TestLoadCachedGobToModel(t *testing.T) {
 	model := NewEmptyModel()
 
-	LoadCachedGobToModel("../test-data/javascript.info", model)
+	if err := LoadCachedGobToModel("../test-data/javascript.info", model); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
 
 	if len(model.TFPD) == 0 {
 		t.Errorf("LoadCachedGobToModel() == 0, want non-zero")
@@ -328,3 +463,804 @@ func TestComputeIDF(t *testing.T) {
 		})
 	}
 }
+
+func TestIndexDocument(t *testing.T) {
+	model := NewEmptyModel()
+
+	IndexDocument(util.IndexedData{
+		URL:     "https://javascript.info/promise-chaining",
+		Title:   "Promise chaining",
+		Content: "Callbacks are chained together",
+	}, model)
+	IndexDocument(util.IndexedData{
+		URL:     "https://javascript.info/callbacks",
+		Title:   "Callbacks",
+		Content: "A promise is returned, then chaining is possible",
+	}, model)
+	//Unrelated pages so the idf of promise is above 0
+	for _, topic := range []string{"closures", "generators", "modules"} {
+		IndexDocument(util.IndexedData{
+			URL:     "https://javascript.info/" + topic,
+			Title:   topic,
+			Content: "Functions and " + topic,
+		}, model)
+	}
+
+	posting := model.Postings["chain"]["https://javascript.info/promise-chaining"]
+	expectedFreqs := [NumFields]int{FieldTitle: 1, FieldURL: 1, FieldBody: 1}
+	if posting.FieldFreqs != expectedFreqs {
+		t.Errorf("Postings[chain].FieldFreqs == %v, want %v", posting.FieldFreqs, expectedFreqs)
+	}
+
+	doc := model.TFPD["https://javascript.info/promise-chaining"]
+	if doc.FieldLengths[FieldTitle] != 2 || doc.FieldLengths[FieldBody] != 4 {
+		t.Errorf("TFPD.FieldLengths == %v, want a title of 2 and body of 4", doc.FieldLengths)
+	}
+
+	if model.FieldLengths[FieldTitle] != 6 {
+		t.Errorf("Model.FieldLengths[FieldTitle] == %d, want 6", model.FieldLengths[FieldTitle])
+	}
+
+	//Terms in different fields must not match as a phrase
+	if matches := MatchPhrase(model, query.Phrase{Terms: []string{"chain", "callback"}}); len(matches) != 0 {
+		t.Errorf("MatchPhrase() across fields == %v, want no matches", matches)
+	}
+
+	results := CalculateBm25(model, query.Term{Value: "promis"}, SearchOptions{K: 10})
+	if len(results.Results) != 2 || results.Results[0].Path != "https://javascript.info/promise-chaining" {
+		t.Errorf("CalculateBm25() == %v, want the title match first", results.Results)
+	}
+
+	bodyOnly := DefaultRankingConfig
+	bodyOnly.FieldWeights = FieldWeights{FieldBody: 1}
+	results = CalculateBm25(model, query.Term{Value: "promis"}, SearchOptions{K: 10, Ranking: &bodyOnly})
+	if len(results.Results) != 2 || results.Results[0].Path != "https://javascript.info/callbacks" {
+		t.Errorf("CalculateBm25() with body weights only == %v, want the body match first", results.Results)
+	}
+}
+
+func TestComputeBM25F(t *testing.T) {
+	posting := Posting{Freq: 2, FieldFreqs: [NumFields]int{FieldTitle: 1, FieldBody: 1}}
+	doc := DocData{FieldLengths: [NumFields]int{FieldTitle: 2, FieldBody: 10}}
+	averages := [NumFields]float32{FieldTitle: 2, FieldBody: 10}
+
+	//With average length documents the weighted frequency is 3*1 + 1*1 = 4, saturated 4*2.2/5.2
+	result := DefaultRankingConfig.ComputeBM25F(posting, doc, averages)
+	if math.Abs(float64(result-1.692308)) > 1e-5 {
+		t.Errorf("Expected: %f, got: %f", 1.692308, result)
+	}
+
+	noWeights := DefaultRankingConfig
+	noWeights.FieldWeights = FieldWeights{}
+	if result := noWeights.ComputeBM25F(posting, doc, averages); result != 0 {
+		t.Errorf("Expected: 0 with zero weights, got: %f", result)
+	}
+}
+
+func TestRankingVariants(t *testing.T) {
+	df := DocFreq{"apple": 100}
+	testCases := []struct {
+		name        string
+		variant     Variant
+		expectedTF  float32
+		expectedIDF float32
+	}{
+		//tf 3 in a document twice the average length is normalised to 3/1.75 = 1.714286
+		{name: "BM25", variant: VariantBM25, expectedTF: 1.294118, expectedIDF: 0.952318},
+		{name: "BM25+", variant: VariantBM25Plus, expectedTF: 2.294118, expectedIDF: 1.000434},
+		{name: "BM25L", variant: VariantBM25L, expectedTF: 1.525547, expectedIDF: 0.998266},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultRankingConfig
+			config.Variant = tc.variant
+			if tf := config.TF(3, 10, 5); math.Abs(float64(tf-tc.expectedTF)) > 1e-5 {
+				t.Errorf("Expected TF: %f, got: %f", tc.expectedTF, tf)
+			}
+			if idf := config.IDF("apple", 1000, df); math.Abs(float64(idf-tc.expectedIDF)) > 1e-5 {
+				t.Errorf("Expected IDF: %f, got: %f", tc.expectedIDF, idf)
+			}
+			if tf := config.TF(0, 10, 5); tf != 0 {
+				t.Errorf("Expected TF: 0 for a missing term, got: %f", tf)
+			}
+		})
+	}
+}
+
+func TestRankingConfigFile(t *testing.T) {
+	dirName := t.TempDir()
+
+	config := DefaultRankingConfig
+	config.Variant = VariantBM25L
+	config.B = 0.3
+	config.FieldWeights[FieldTitle] = 5
+	if err := SaveRankingConfig(dirName, config); err != nil {
+		t.Fatalf("SaveRankingConfig() returned %v", err)
+	}
+
+	model := NewEmptyModel()
+	if err := readRankingConfig(dirName, model); err != nil {
+		t.Fatalf("readRankingConfig() returned %v", err)
+	}
+	if model.Ranking != config {
+		t.Errorf("readRankingConfig() == %+v, want %+v", model.Ranking, config)
+	}
+
+	if err := os.WriteFile(path.Join(dirName, RankingFileName), []byte(`{"variant": "bm25plus", "b": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := readRankingConfig(dirName, model); err == nil {
+		t.Errorf("readRankingConfig() with b of 2 returned no error")
+	}
+
+	if err := readRankingConfig(t.TempDir(), NewEmptyModel()); err != nil {
+		t.Errorf("readRankingConfig() without a file returned %v, want the defaults", err)
+	}
+}
+
+func TestRankingConfigValidate(t *testing.T) {
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(1))
+	weights := func(weight float32) FieldWeights {
+		config := DefaultRankingConfig.FieldWeights
+		config[FieldTitle] = weight
+		return config
+	}
+
+	testCases := []struct {
+		name    string
+		modify  func(c *RankingConfig)
+		wantErr bool
+	}{
+		{name: "Defaults", modify: func(c *RankingConfig) {}},
+		{name: "Negative k1", modify: func(c *RankingConfig) { c.K1 = -1 }, wantErr: true},
+		{name: "NaN k1", modify: func(c *RankingConfig) { c.K1 = nan }, wantErr: true},
+		{name: "Infinite k1", modify: func(c *RankingConfig) { c.K1 = inf }, wantErr: true},
+		{name: "NaN b", modify: func(c *RankingConfig) { c.B = nan }, wantErr: true},
+		{name: "Negative infinite b", modify: func(c *RankingConfig) { c.B = -inf }, wantErr: true},
+		{name: "NaN delta", modify: func(c *RankingConfig) { c.Delta = nan }, wantErr: true},
+		{name: "Infinite delta", modify: func(c *RankingConfig) { c.Delta = inf }, wantErr: true},
+		{name: "NaN weight", modify: func(c *RankingConfig) { c.FieldWeights = weights(nan) }, wantErr: true},
+		{name: "Infinite weight", modify: func(c *RankingConfig) { c.FieldWeights = weights(inf) }, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultRankingConfig
+			tc.modify(&config)
+			if err := config.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildSnippets(t *testing.T) {
+	terms := map[string]bool{"promis": true, "chain": true}
+
+	snippets := BuildSnippets("Promises & chaining <b>work</b>", terms)
+	if len(snippets) != 1 {
+		t.Fatalf("BuildSnippets() returned %d snippets, want 1", len(snippets))
+	}
+
+	expected := Snippet{
+		Text:       "Promises & chaining <b>work</b>",
+		Highlights: []Highlight{{Start: 0, End: 8}, {Start: 11, End: 19}},
+		HTML:       "<mark>Promises</mark> &amp; <mark>chaining</mark> &lt;b&gt;work&lt;/b&gt;",
+	}
+	if !reflect.DeepEqual(snippets[0], expected) {
+		t.Errorf("Expected: %#v, got: %#v", expected, snippets[0])
+	}
+
+	long := strings.Repeat("filler words here ", 20) + "promise chaining " + strings.Repeat("more filler words ", 20) + "chaining"
+	snippets = BuildSnippets(long, terms)
+	if len(snippets) != 2 {
+		t.Fatalf("BuildSnippets() returned %d snippets, want 2", len(snippets))
+	}
+	if !strings.HasPrefix(snippets[0].Text, "…") || !strings.Contains(snippets[0].HTML, "<mark>promise</mark> <mark>chaining</mark>") {
+		t.Errorf("BuildSnippets() first snippet == %q, want the window with both terms", snippets[0].Text)
+	}
+	for _, h := range snippets[0].Highlights {
+		if got := string([]rune(snippets[0].Text)[h.Start:h.End]); got != "promise" && got != "chaining" {
+			t.Errorf("Highlight %v covers %q, want a query term", h, got)
+		}
+	}
+
+	snippets = BuildSnippets("Nothing matches here", terms)
+	if len(snippets) != 1 || len(snippets[0].Highlights) != 0 || snippets[0].Text != "Nothing matches here" {
+		t.Errorf("BuildSnippets() without matches == %#v, want the start of the content", snippets)
+	}
+}
+
+func TestAddSnippets(t *testing.T) {
+	model := NewEmptyModel()
+	IndexDocument(util.IndexedData{URL: "/promises", Title: "Promises", Content: "A promise represents a value"}, model)
+
+	results := []ResultsMap{{Path: "/promises"}, {Path: "/missing"}}
+	AddSnippets(model, results, query.Term{Value: "promis"})
+
+	if len(results[0].Snippets) != 1 || results[0].Snippets[0].HTML != "A <mark>promise</mark> represents a value" {
+		t.Errorf("AddSnippets() == %#v, want the stored content with promise marked", results[0].Snippets)
+	}
+	if results[1].Snippets != nil {
+		t.Errorf("AddSnippets() for a missing document == %#v, want none", results[1].Snippets)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	model := NewEmptyModel()
+	for _, topic := range []string{"promise-chaining", "callbacks", "closures", "generators", "modules"} {
+		IndexDocument(util.IndexedData{
+			URL:     "https://javascript.info/" + topic,
+			Title:   strings.ReplaceAll(topic, "-", " "),
+			Content: "Functions and " + topic,
+		}, model)
+	}
+	model.DA = float32(model.TermCount) / float32(len(model.TFPD))
+
+	q := query.Boolean{Clauses: []query.Clause{
+		{Occur: query.Should, Node: query.Term{Value: "promis"}},
+		{Occur: query.Should, Node: query.Term{Value: "chain"}},
+	}}
+
+	results := CalculateBm25(model, q, SearchOptions{K: 10})
+	if results.Results[0].Explanation != nil {
+		t.Errorf("CalculateBm25() without Explain set an explanation")
+	}
+
+	results = CalculateBm25(model, q, SearchOptions{K: 10, Explain: true})
+	if len(results.Results) != 1 {
+		t.Fatalf("CalculateBm25() == %v, want 1 result", results.Results)
+	}
+	explanation := results.Results[0].Explanation
+	if explanation == nil {
+		t.Fatalf("CalculateBm25() with Explain has no explanation")
+	}
+	if explanation.Method != "bm25" || explanation.DocCount != 5 || explanation.DA != model.DA {
+		t.Errorf("Explanation == %+v, want method bm25 over 5 documents with DA %v", explanation, model.DA)
+	}
+	if len(explanation.Terms) != 2 {
+		t.Fatalf("Explanation.Terms == %v, want promis and chain", explanation.Terms)
+	}
+
+	var sum float32
+	for _, term := range explanation.Terms {
+		if term.DF != 1 || term.FieldFreqs["title"] != 1 {
+			t.Errorf("Explanation of %s == %+v, want df 1 and a title match", term.Term, term)
+		}
+		if math.Abs(float64(term.Score-term.TF*term.IDF)) > 1e-6 {
+			t.Errorf("Explanation of %s score == %v, want tf × idf %v", term.Term, term.Score, term.TF*term.IDF)
+		}
+		sum += term.Score
+	}
+	if math.Abs(float64(sum-results.Results[0].TF)) > 1e-5 {
+		t.Errorf("Explained term scores add up to %v, want the result score %v", sum, results.Results[0].TF)
+	}
+
+	//The phrase boost normalises the document's total length by the average total length, not DA which counts
+	//distinct terms
+	phrase := query.Phrase{Terms: []string{"promis", "chain"}}
+	results = CalculateBm25(model, phrase, SearchOptions{K: 10, Explain: true})
+	if len(results.Results) != 1 || len(results.Results[0].Explanation.Phrases) != 1 {
+		t.Fatalf("CalculateBm25() of a phrase == %v, want 1 result with its phrase explained", results.Results)
+	}
+	explanation = results.Results[0].Explanation
+	var avgDocLength float32
+	for _, doc := range model.TFPD {
+		avgDocLength += float32(doc.TermCount)
+	}
+	avgDocLength /= float32(len(model.TFPD))
+	if math.Abs(float64(explanation.AvgDocLength-avgDocLength)) > 1e-5 {
+		t.Errorf("Explanation.AvgDocLength == %v, want the average TermCount %v", explanation.AvgDocLength, avgDocLength)
+	}
+	explained := explanation.Phrases[0]
+	var idf float32
+	for _, term := range phrase.Terms {
+		idf += model.Ranking.IDF(term, len(model.TFPD), model.DF)
+	}
+	boost := proximityWeight * model.Ranking.TF(explained.PhraseFreq, explanation.DocLength, avgDocLength) * idf
+	if math.Abs(float64(explained.Boost-boost)) > 1e-5 {
+		t.Errorf("Phrase boost == %v, want %v normalised by the average document length", explained.Boost, boost)
+	}
+	sum = explained.Boost
+	for _, term := range explanation.Terms {
+		sum += term.Score
+	}
+	if math.Abs(float64(sum-results.Results[0].TF)) > 1e-5 {
+		t.Errorf("Explained phrase scores add up to %v, want the result score %v", sum, results.Results[0].TF)
+	}
+}
+
+func TestWriteIndex(t *testing.T) {
+	dir := t.TempDir()
+	model := NewEmptyModel()
+	documents := make(map[string]util.IndexedData)
+	for _, topic := range []string{"promise-chaining", "callbacks", "closures"} {
+		doc := util.IndexedData{
+			URL:     "https://javascript.info/" + topic,
+			Title:   strings.ReplaceAll(topic, "-", " "),
+			Content: "Functions and " + topic,
+		}
+		documents[doc.URL] = doc
+		IndexDocument(doc, model)
+		model.DocCount += 1
+	}
+
+	manifest, err := WriteIndex(model, FileOpsImpl{}, dir)
+	if err != nil {
+		t.Fatalf("WriteIndex() error: %v", err)
+	}
+	if err := CompressAndWriteGzipFile(DocumentsFileName, documents, dir); err != nil {
+		t.Fatalf("CompressAndWriteGzipFile() error: %v", err)
+	}
+	if err := WriteManifest(manifest, dir); err != nil {
+		t.Fatalf("WriteManifest() error: %v", err)
+	}
+
+	loaded := NewEmptyModel()
+	if err := LoadCachedGobToModel(dir, loaded); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded.TFPD, model.TFPD) {
+		t.Errorf("loaded TFPD == %v, want %v", loaded.TFPD, model.TFPD)
+	}
+	if !reflect.DeepEqual(loaded.DF, model.DF) {
+		t.Errorf("loaded DF == %v, want %v", loaded.DF, model.DF)
+	}
+	if !reflect.DeepEqual(loaded.Postings, model.Postings) {
+		t.Errorf("loaded Postings == %v, want %v", loaded.Postings, model.Postings)
+	}
+	if loaded.FieldLengths != model.FieldLengths || loaded.TermCount != model.TermCount || loaded.DocCount != 3 {
+		t.Errorf("loaded counts == %v %d %d, want %v %d 3", loaded.FieldLengths, loaded.TermCount, loaded.DocCount, model.FieldLengths, model.TermCount)
+	}
+	if !reflect.DeepEqual(loaded.Documents, model.Documents) {
+		t.Errorf("loaded Documents == %v, want %v", loaded.Documents, model.Documents)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	model := NewEmptyModel()
+	IndexDocument(util.IndexedData{URL: "https://javascript.info/closures", Title: "Closures"}, model)
+	model.DocCount = 1
+
+	manifest, err := WriteIndex(model, FileOpsImpl{}, dir)
+	if err != nil {
+		t.Fatalf("WriteIndex() error: %v", err)
+	}
+	manifest.SourceURL = "https://javascript.info"
+	if err := WriteManifest(manifest, dir); err != nil {
+		t.Fatalf("WriteManifest() error: %v", err)
+	}
+
+	written, err := ReadManifest(dir)
+	if err != nil || written == nil {
+		t.Fatalf("ReadManifest() == %v, %v, want the manifest", written, err)
+	}
+	if written.Version != ManifestVersion || written.DocCount != 1 || written.SourceURL != "https://javascript.info" {
+		t.Errorf("ReadManifest() == %+v, want version %d with 1 document", written, ManifestVersion)
+	}
+	if _, ok := written.Files[IndexFileName]; !ok || len(written.Files) != 1 {
+		t.Errorf("Manifest.Files == %v, want only %s", written.Files, IndexFileName)
+	}
+	if err := VerifyIndex(dir); err != nil {
+		t.Errorf("VerifyIndex() error: %v", err)
+	}
+
+	//A newer format is rejected
+	newer := *written
+	newer.Version = ManifestVersion + 1
+	if err := WriteJSONFile(ManifestFileName, newer, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyIndex(dir); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("VerifyIndex() with version %d == %v, want an unsupported version error", newer.Version, err)
+	}
+	if err := WriteJSONFile(ManifestFileName, written, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	//The crawl report and failed urls are checksummed when the crawl wrote them
+	if err := WriteJSONFile(CrawlReportFileName, map[string]PageOutcome{"https://javascript.info/closures": {Outcome: "indexed"}}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteJSONFile(FailedURLsFileName, []string{"https://javascript.info/timeout"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteManifest(manifest, dir); err != nil {
+		t.Fatalf("WriteManifest() error: %v", err)
+	}
+	if written, err = ReadManifest(dir); err != nil || len(written.Files) != 3 {
+		t.Fatalf("ReadManifest() == %v, %v, want the index, crawl report and failed urls", written, err)
+	}
+	for _, fileName := range []string{CrawlReportFileName, FailedURLsFileName} {
+		if _, ok := written.Files[fileName]; !ok {
+			t.Errorf("Manifest.Files == %v, want %s", written.Files, fileName)
+		}
+		filePath := path.Join(dir, fileName)
+		original, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyIndex(dir); err == nil {
+			t.Errorf("VerifyIndex() with a corrupt %s == nil, want an error", fileName)
+		}
+		if err := os.WriteFile(filePath, original, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := VerifyIndex(dir); err != nil {
+		t.Errorf("VerifyIndex() error: %v", err)
+	}
+
+	//A corrupt file fails to load and leaves the model untouched
+	indexPath := path.Join(dir, IndexFileName)
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(indexPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewEmptyModel()
+	loaded.DocCount = 7
+	if err := LoadCachedGobToModel(dir, loaded); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("LoadCachedGobToModel() of a corrupt index == %v, want a checksum error", err)
+	}
+	if loaded.DocCount != 7 || len(loaded.TFPD) != 0 {
+		t.Errorf("LoadCachedGobToModel() of a corrupt index changed the model")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filePath := path.Join(dir, "url-files.gz")
+
+	for _, content := range []string{"old", "new"} {
+		if err := writeFileAtomic(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("writeFileAtomic() error: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil || string(data) != "new" {
+		t.Errorf("writeFileAtomic() wrote %q, %v, want \"new\"", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("writeFileAtomic() left %d files, want only the target", len(entries))
+	}
+}
+
+func TestCommitGeneration(t *testing.T) {
+	dir := t.TempDir()
+
+	//Indexes without generations are read from the directory itself
+	if resolved, err := ResolveIndexDir(dir); err != nil || resolved != dir {
+		t.Errorf("ResolveIndexDir() without %s == %q, %v, want %q", CurrentFileName, resolved, err, dir)
+	}
+
+	generations := []string{"gen-1", "gen-2", "gen-3"}
+	for _, generation := range generations {
+		model := NewEmptyModel()
+		IndexDocument(util.IndexedData{URL: "https://javascript.info/" + generation, Title: generation}, model)
+		model.DocCount = 1
+
+		generationDir := path.Join(dir, generation)
+		if err := os.MkdirAll(generationDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := WriteIndex(model, FileOpsImpl{}, generationDir)
+		if err != nil {
+			t.Fatalf("WriteIndex() error: %v", err)
+		}
+		if err := WriteManifest(manifest, generationDir); err != nil {
+			t.Fatalf("WriteManifest() error: %v", err)
+		}
+		if err := CommitGeneration(dir, generation); err != nil {
+			t.Fatalf("CommitGeneration() error: %v", err)
+		}
+	}
+
+	if resolved, err := ResolveIndexDir(dir); err != nil || resolved != path.Join(dir, "gen-3") {
+		t.Errorf("ResolveIndexDir() == %q, %v, want gen-3", resolved, err)
+	}
+	//The previous generation is kept, older ones are removed
+	if _, err := os.Stat(path.Join(dir, "gen-2")); err != nil {
+		t.Errorf("CommitGeneration() removed the previous generation: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "gen-1")); !os.IsNotExist(err) {
+		t.Errorf("CommitGeneration() kept gen-1, want it removed")
+	}
+
+	model := NewEmptyModel()
+	if err := LoadCachedGobToModel(dir, model); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+	if _, ok := model.TFPD["https://javascript.info/gen-3"]; !ok || len(model.TFPD) != 1 {
+		t.Errorf("LoadCachedGobToModel() loaded %v, want the current generation only", model.TFPD)
+	}
+
+	//gen-4 was abandoned after gen-3 was committed so it sorts after it, gen-3 is still the generation kept.
+	//gen-6 belongs to a crawl that is still running
+	for _, abandoned := range []string{"gen-4", "gen-6"} {
+		if err := os.MkdirAll(path.Join(dir, abandoned), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CommitGeneration(dir, "gen-5"); err != nil {
+		t.Fatalf("CommitGeneration() error: %v", err)
+	}
+	for generation, kept := range map[string]bool{"gen-2": false, "gen-3": true, "gen-4": false, "gen-6": true} {
+		if _, err := os.Stat(path.Join(dir, generation)); (err == nil) != kept {
+			t.Errorf("After committing gen-5 %s exists == %v, want %v", generation, err == nil, kept)
+		}
+	}
+
+	if err := os.WriteFile(path.Join(dir, CurrentFileName), []byte("../elsewhere\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveIndexDir(dir); err == nil {
+		t.Errorf("ResolveIndexDir() with an invalid generation == nil, want an error")
+	}
+}
+
+func TestSegments(t *testing.T) {
+	dir := t.TempDir()
+	model := NewEmptyModel()
+	//A tiny segment size puts every document in its own segment
+	writer := NewSegmentWriter(dir, 1)
+	topics := []string{"promise-chaining", "callbacks", "closures", "generators"}
+	for _, topic := range topics {
+		doc := util.IndexedData{
+			URL:     "https://javascript.info/" + topic,
+			Title:   strings.ReplaceAll(topic, "-", " "),
+			Content: "Functions and " + topic,
+		}
+		if err := writer.Add(doc); err != nil {
+			t.Fatalf("SegmentWriter.Add() error: %v", err)
+		}
+		IndexDocument(doc, model)
+		model.DocCount += 1
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("SegmentWriter.Close() error: %v", err)
+	}
+	if err := writer.Add(util.IndexedData{URL: "late"}); err != ErrWriterClosed {
+		t.Errorf("SegmentWriter.Add() after Close == %v, want ErrWriterClosed", err)
+	}
+
+	files, err := segmentFiles(dir)
+	if err != nil || len(files) != len(topics) {
+		t.Fatalf("segmentFiles() == %v, %v, want %d segments", files, err, len(topics))
+	}
+
+	read := make(map[string]bool)
+	var mutex sync.Mutex
+	err = ReadSegments(dir, files, func(doc util.IndexedData) {
+		mutex.Lock()
+		read[doc.URL] = true
+		mutex.Unlock()
+	})
+	if err != nil || len(read) != len(topics) {
+		t.Errorf("ReadSegments() read %v, %v, want every document", read, err)
+	}
+
+	manifest, err := WriteIndex(model, FileOpsImpl{}, dir)
+	if err != nil {
+		t.Fatalf("WriteIndex() error: %v", err)
+	}
+	if err := WriteManifest(manifest, dir); err != nil {
+		t.Fatalf("WriteManifest() error: %v", err)
+	}
+	written, _ := ReadManifest(dir)
+	if _, ok := written.Files["documents-000001.gz"]; !ok {
+		t.Errorf("Manifest.Files == %v, want the segments checksummed", written.Files)
+	}
+
+	loaded := NewEmptyModel()
+	if err := LoadCachedGobToModel(dir, loaded); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+	if len(loaded.Documents) != 0 || loaded.DocStore == nil || loaded.DocStore.Len() != len(topics) {
+		t.Fatalf("LoadCachedGobToModel() loaded %d documents into memory, want them read from the segments", len(loaded.Documents))
+	}
+
+	results := []ResultsMap{{Path: "https://javascript.info/closures"}}
+	AddSnippets(loaded, results, query.Term{Value: "closur"})
+	if len(results[0].Snippets) != 1 || results[0].Snippets[0].Text != "Functions and closures" {
+		t.Errorf("AddSnippets() from segments == %#v, want the stored content", results[0].Snippets)
+	}
+
+	//Without the computed index the segments are indexed again
+	if err := os.Remove(path.Join(dir, IndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(dir, ManifestFileName)); err != nil {
+		t.Fatal(err)
+	}
+	reindexed := NewEmptyModel()
+	if err := LoadCachedGobToModel(dir, reindexed); err != nil {
+		t.Fatalf("LoadCachedGobToModel() without an index error: %v", err)
+	}
+	if reindexed.DocCount != len(topics) || !reflect.DeepEqual(reindexed.DF, model.DF) {
+		t.Errorf("LoadCachedGobToModel() from segments indexed %d documents, want %d with the same DF", reindexed.DocCount, len(topics))
+	}
+	if len(reindexed.Documents) != 0 || reindexed.DocStore == nil {
+		t.Errorf("LoadCachedGobToModel() from segments kept %d documents in memory, want them read from the segments", len(reindexed.Documents))
+	}
+}
+
+func TestOpenSegmentWriter(t *testing.T) {
+	dir := t.TempDir()
+	writer := NewSegmentWriter(dir, 1<<20)
+	for _, topic := range []string{"callbacks", "closures"} {
+		if err := writer.Add(util.IndexedData{URL: "https://javascript.info/" + topic, Content: topic}); err != nil {
+			t.Fatalf("SegmentWriter.Add() error: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("SegmentWriter.Flush() error: %v", err)
+	}
+	//A document written after the flush is lost when the crawl is interrupted
+	if err := writer.Add(util.IndexedData{URL: "https://javascript.info/lost"}); err != nil {
+		t.Fatalf("SegmentWriter.Add() error: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("SegmentWriter.Flush() error: %v", err)
+	}
+	if err := CompressAndWriteGzipFile(SegmentIndexFileName, map[string]string{
+		"https://javascript.info/callbacks": "documents-000001.gz",
+		"https://javascript.info/closures":  "documents-000001.gz",
+	}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenSegmentWriter(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("OpenSegmentWriter() error: %v", err)
+	}
+	if !reopened.Contains("https://javascript.info/closures") || reopened.Contains("https://javascript.info/lost") {
+		t.Errorf("OpenSegmentWriter() index == %v, want the flushed documents", reopened.index)
+	}
+	if err := reopened.Add(util.IndexedData{URL: "https://javascript.info/generators", Content: "generators"}); err != nil {
+		t.Fatalf("SegmentWriter.Add() error: %v", err)
+	}
+	//Documents of the open segment are read from memory and the others from their segment
+	written, err := reopened.Get([]string{"https://javascript.info/closures", "https://javascript.info/generators", "https://javascript.info/lost"})
+	if err != nil || len(written) != 2 || written["https://javascript.info/closures"].Content != "closures" || written["https://javascript.info/generators"].Content != "generators" {
+		t.Errorf("SegmentWriter.Get() == %v, %v, want the flushed and pending documents", written, err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("SegmentWriter.Close() error: %v", err)
+	}
+
+	files, err := segmentFiles(dir)
+	if err != nil || !reflect.DeepEqual(files, []string{"documents-000001.gz", "documents-000002.gz"}) {
+		t.Fatalf("segmentFiles() == %v, %v, want the unreferenced segment replaced", files, err)
+	}
+	store, err := OpenSegmentStore(dir)
+	if err != nil {
+		t.Fatalf("OpenSegmentStore() error: %v", err)
+	}
+	documents, err := store.Get([]string{"https://javascript.info/callbacks", "https://javascript.info/generators", "https://javascript.info/lost"})
+	if err != nil || len(documents) != 2 || documents["https://javascript.info/generators"].Content != "generators" {
+		t.Errorf("SegmentStore.Get() == %v, %v, want the documents before and after reopening", documents, err)
+	}
+}
+
+func TestRemoveDocument(t *testing.T) {
+	docs := []util.IndexedData{
+		{URL: "https://javascript.info/promise-chaining", Title: "Promise chaining", Content: "Promises are chained"},
+		{URL: "https://javascript.info/callbacks", Title: "Callbacks", Content: "A callback is called later"},
+		{URL: "https://javascript.info/closures", Title: "Closures", Content: "Functions remember their scope"},
+	}
+	model := NewEmptyModel()
+	for _, doc := range docs {
+		IndexDocument(doc, model)
+		model.DocCount += 1
+		model.UrlFiles[doc.URL] = doc.Title
+		model.ReverseUrlFiles[doc.Title] = doc.URL
+	}
+	model.DA = float32(model.TermCount) / float32(model.DocCount)
+
+	if !RemoveDocument(docs[1].URL, model) {
+		t.Fatalf("RemoveDocument() == false, want true")
+	}
+	if RemoveDocument(docs[1].URL, model) {
+		t.Errorf("RemoveDocument() of a removed document == true, want false")
+	}
+
+	//The model must match one built without the removed document
+	expected := NewEmptyModel()
+	for _, doc := range []util.IndexedData{docs[0], docs[2]} {
+		IndexDocument(doc, expected)
+	}
+	if !reflect.DeepEqual(model.DF, expected.DF) {
+		t.Errorf("DF == %v, want %v", model.DF, expected.DF)
+	}
+	if !reflect.DeepEqual(model.Postings, expected.Postings) {
+		t.Errorf("Postings == %v, want %v", model.Postings, expected.Postings)
+	}
+	if model.TermCount != expected.TermCount || model.FieldLengths != expected.FieldLengths {
+		t.Errorf("TermCount, FieldLengths == %d %v, want %d %v", model.TermCount, model.FieldLengths, expected.TermCount, expected.FieldLengths)
+	}
+	if model.DocCount != 2 || len(model.TFPD) != 2 || len(model.Documents) != 2 {
+		t.Errorf("DocCount == %d with %d documents, want 2", model.DocCount, len(model.TFPD))
+	}
+	if _, ok := model.UrlFiles[docs[1].URL]; ok {
+		t.Errorf("UrlFiles still maps the removed document")
+	}
+	if _, ok := model.ReverseUrlFiles[docs[1].Title]; ok {
+		t.Errorf("ReverseUrlFiles still maps the removed document")
+	}
+	if want := float32(expected.TermCount) / 2; model.DA != want {
+		t.Errorf("DA == %v, want %v", model.DA, want)
+	}
+}
+
+func TestUpdateDocument(t *testing.T) {
+	model := NewEmptyModel()
+	IndexDocument(util.IndexedData{URL: "https://javascript.info/closures", Title: "Closures", Content: "Functions remember their scope"}, model)
+	model.DocCount = 1
+
+	updated := util.IndexedData{URL: "https://javascript.info/closures", Title: "Closures", Content: "A closure is a function with its environment"}
+	UpdateDocument(updated, model)
+
+	expected := NewEmptyModel()
+	IndexDocument(updated, expected)
+	if !reflect.DeepEqual(model.DF, expected.DF) || !reflect.DeepEqual(model.Postings, expected.Postings) {
+		t.Errorf("UpdateDocument() DF == %v, want %v", model.DF, expected.DF)
+	}
+	if model.DocCount != 1 || model.TermCount != expected.TermCount {
+		t.Errorf("UpdateDocument() DocCount, TermCount == %d %d, want 1 %d", model.DocCount, model.TermCount, expected.TermCount)
+	}
+	if model.Documents[updated.URL].Content != updated.Content {
+		t.Errorf("UpdateDocument() stored %q, want the new content", model.Documents[updated.URL].Content)
+	}
+
+	//Updating a document that isn't indexed adds it
+	UpdateDocument(util.IndexedData{URL: "https://javascript.info/callbacks", Title: "Callbacks"}, model)
+	if model.DocCount != 2 || len(model.TFPD) != 2 {
+		t.Errorf("UpdateDocument() of a new document DocCount == %d, want 2", model.DocCount)
+	}
+
+	//A search running while a document is updated always finds it, a long page makes the update slow enough to overlap
+	long := updated
+	long.Content = strings.Repeat("A closure is a function with its environment ", 2000)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			UpdateDocument(long, model)
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		results := CalculateBm25(model, query.Term{Value: "closur"}, SearchOptions{K: 10})
+		if results.Total != 1 {
+			t.Fatalf("CalculateBm25() during UpdateDocument() found %d documents, want 1", results.Total)
+		}
+	}
+	wg.Wait()
+	if model.DocCount != 2 || model.DF["closur"] != 1 {
+		t.Errorf("Concurrent UpdateDocument() DocCount, DF == %d %d, want 2 1", model.DocCount, model.DF["closur"])
+	}
+}
@@ -0,0 +1,157 @@
+package bm25
+
+import (
+	"github.com/deanrtaylor1/gosearch/query"
+)
+
+// TermExplanation is how a single query term contributed to the score of a document
+type TermExplanation struct {
+	Term string `json:"term"`
+	//Freq is the number of times the term occurs in the document and FieldFreqs the occurrences per field
+	Freq       int            `json:"freq"`
+	FieldFreqs map[string]int `json:"field_freqs,omitempty"`
+	TF         float32        `json:"tf"`
+	IDF        float32        `json:"idf"`
+	//DF is the number of documents containing the term
+	DF    int     `json:"df"`
+	Score float32 `json:"score"`
+}
+
+// PhraseExplanation is the proximity boost a phrase or proximity query added to the score of a document
+type PhraseExplanation struct {
+	Terms      []string `json:"terms"`
+	Slop       int      `json:"slop"`
+	PhraseFreq float32  `json:"phrase_freq"`
+	Boost      float32  `json:"boost"`
+}
+
+// Explanation is the breakdown of the score of a single result, Method is the scorer that ranked it (bm25 or tfidf).
+// Terms has one entry per distinct term while a term repeated in the query adds to the score once per occurrence,
+// so the parts only add up to the score when no term is repeated
+type Explanation struct {
+	Method  string         `json:"method"`
+	Ranking *RankingConfig `json:"ranking,omitempty"`
+	//DocLength is the number of terms in the document and AvgDocLength the average across the model, phrase boosts
+	//are normalised by them. DA is the average number of distinct terms
+	DocLength       int                 `json:"doc_length"`
+	AvgDocLength    float32             `json:"avg_doc_length,omitempty"`
+	FieldLengths    map[string]int      `json:"field_lengths,omitempty"`
+	DA              float32             `json:"da"`
+	AvgFieldLengths map[string]float32  `json:"avg_field_lengths,omitempty"`
+	DocCount        int                 `json:"doc_count"`
+	Terms           []TermExplanation   `json:"terms"`
+	Phrases         []PhraseExplanation `json:"phrases,omitempty"`
+}
+
+// This function returns the distinct terms of a query in the order they appear, the terms each scorer's
+// explanation breaks the score down by. Repeated terms are listed once, so for a query such as
+// "promise OR promise" the term parts don't add up to the score
+func ExplainTerms(q query.Node) []string {
+	seen := make(map[string]bool)
+	terms := []string{}
+	for _, term := range query.Terms(q) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// This function returns the phrases of a query that a document has to contain, excluded phrases are left out
+func explainPhrases(node query.Node) []query.Phrase {
+	phrases := []query.Phrase{}
+	var walk func(query.Node)
+	walk = func(n query.Node) {
+		switch n := n.(type) {
+		case query.Phrase:
+			phrases = append(phrases, n)
+		case query.Boolean:
+			for _, clause := range n.Clauses {
+				if clause.Occur != query.MustNot {
+					walk(clause.Node)
+				}
+			}
+		}
+	}
+	walk(node)
+	return phrases
+}
+
+// This function explains the bm25 score of each result, the caller must hold the ModelLock
+func explainBm25(model *Model, results []ResultsMap, q query.Node, ranking RankingConfig, averages [NumFields]float32) {
+	terms := ExplainTerms(q)
+	phrases := explainPhrases(q)
+	N := len(model.TFPD)
+
+	//Each phrase is matched against the whole index, so it is matched once rather than once per result
+	phraseFreqs := make([]map[string]float32, len(phrases))
+	for i, phrase := range phrases {
+		phraseFreqs[i] = MatchPhrase(model, phrase)
+	}
+
+	avgFieldLengths := make(map[string]float32, NumFields)
+	for field, average := range averages {
+		avgFieldLengths[FieldNames[field]] = average
+	}
+
+	for i := range results {
+		doc := model.TFPD[results[i].Path]
+		fieldLengths := make(map[string]int, NumFields)
+		for field, length := range doc.FieldLengths {
+			fieldLengths[FieldNames[field]] = length
+		}
+
+		explanation := &Explanation{
+			Method:          "bm25",
+			Ranking:         &ranking,
+			DocLength:       doc.TermCount,
+			AvgDocLength:    averageDocLength(averages),
+			FieldLengths:    fieldLengths,
+			DA:              model.DA,
+			AvgFieldLengths: avgFieldLengths,
+			DocCount:        N,
+			Terms:           []TermExplanation{},
+		}
+
+		for _, term := range terms {
+			posting := model.Postings[term][results[i].Path]
+			fieldFreqs := make(map[string]int)
+			for field, freq := range posting.FieldFreqs {
+				if freq > 0 {
+					fieldFreqs[FieldNames[field]] = freq
+				}
+			}
+			tf := ranking.ComputeBM25F(posting, doc, averages)
+			idf := ranking.IDF(term, N, model.DF)
+			explanation.Terms = append(explanation.Terms, TermExplanation{
+				Term:       term,
+				Freq:       posting.Freq,
+				FieldFreqs: fieldFreqs,
+				TF:         tf,
+				IDF:        idf,
+				DF:         model.DF[term],
+				Score:      tf * idf,
+			})
+		}
+
+		for p, phrase := range phrases {
+			phraseFreq := phraseFreqs[p][results[i].Path]
+			if phraseFreq == 0 {
+				continue
+			}
+			var idf float32
+			for _, token := range phrase.Terms {
+				idf += ranking.IDF(token, N, model.DF)
+			}
+			explanation.Phrases = append(explanation.Phrases, PhraseExplanation{
+				Terms:      phrase.Terms,
+				Slop:       phrase.Slop,
+				PhraseFreq: phraseFreq,
+				Boost:      proximityWeight * ranking.TF(phraseFreq, doc.TermCount, averageDocLength(averages)) * idf,
+			})
+		}
+
+		results[i].Explanation = explanation
+	}
+}
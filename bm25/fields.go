@@ -0,0 +1,209 @@
+package bm25
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/deanrtaylor1/gosearch/lexer"
+	"github.com/deanrtaylor1/gosearch/util"
+)
+
+// Field is a part of a document that is indexed separately so BM25F can weight it
+type Field int
+
+const (
+	FieldTitle Field = iota
+	FieldHeadings
+	FieldDescription
+	FieldURL
+	FieldBody
+	NumFields
+)
+
+// FieldNames are the names used for the fields in the API and CLI
+var FieldNames = [NumFields]string{"title", "headings", "description", "url", "body"}
+
+// FieldWeights is how much a match in each field counts towards the BM25F score
+type FieldWeights [NumFields]float32
+
+// DefaultFieldWeights float title matches to the top, a document indexed from plain content only has a body
+var DefaultFieldWeights = FieldWeights{
+	FieldTitle:       3,
+	FieldHeadings:    2,
+	FieldDescription: 1.5,
+	FieldURL:         1.5,
+	FieldBody:        1,
+}
+
+// fieldPositionGap separates the positions of consecutive fields so phrases can't match across them
+const fieldPositionGap = 100
+
+// Field weights are stored by name e.g. {"title": 3, "body": 1} so the file is readable
+func (w FieldWeights) MarshalJSON() ([]byte, error) {
+	named := make(map[string]float32, NumFields)
+	for field, weight := range w {
+		named[FieldNames[field]] = weight
+	}
+	return json.Marshal(named)
+}
+
+// Fields missing from the JSON keep their current weight
+func (w *FieldWeights) UnmarshalJSON(data []byte) error {
+	named := make(map[string]float32)
+	if err := json.Unmarshal(data, &named); err != nil {
+		return err
+	}
+	for name, weight := range named {
+		field, ok := ParseField(name)
+		if !ok {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		w[field] = weight
+	}
+	return nil
+}
+
+// This function looks up a field by its name e.g. "title"
+func ParseField(name string) (Field, bool) {
+	for field, fieldName := range FieldNames {
+		if strings.EqualFold(name, fieldName) {
+			return Field(field), true
+		}
+	}
+	return 0, false
+}
+
+// This function indexes every field of a crawled page into the model, its content is kept in Documents unless the
+// model reads it from segments
+func IndexDocument(doc util.IndexedData, model *Model) {
+	analyzed := analyzeFields(documentFields(doc))
+
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+	indexDocumentLocked(doc, analyzed, model)
+}
+
+// This function adds an analyzed page to the model, the caller must hold the ModelLock
+func indexDocumentLocked(doc util.IndexedData, analyzed analyzedFields, model *Model) {
+	addFields(doc.URL, analyzed, model)
+	//Pages streamed to segments are read from them when needed rather than held in memory
+	if model.DocWriter == nil && model.DocStore == nil {
+		model.Documents[doc.URL] = doc
+	}
+}
+
+// This function returns the content of each field of a crawled page
+func documentFields(doc util.IndexedData) [NumFields]string {
+	var fields [NumFields]string
+	fields[FieldTitle] = doc.Title
+	fields[FieldHeadings] = doc.Headings
+	fields[FieldDescription] = doc.Description
+	fields[FieldURL] = urlPath(doc.URL)
+	fields[FieldBody] = doc.Content
+	return fields
+}
+
+// urlPath returns the path of a url, or the url itself if it can't be parsed
+func urlPath(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsedURL.Path
+}
+
+// analyzedFields are the term frequencies, positions and field lengths of a document before it is added to a model
+type analyzedFields struct {
+	tf           TermFreq
+	positions    map[string][]int
+	fieldFreqs   map[string][NumFields]int
+	fieldLengths [NumFields]int
+}
+
+// This function tokenizes each field and adds the document to the postings, DF and field lengths of the model
+func indexFields(path string, fields [NumFields]string, model *Model) {
+	analyzed := analyzeFields(fields)
+
+	model.ModelLock.Lock()
+	addFields(path, analyzed, model)
+	model.ModelLock.Unlock()
+}
+
+// This function tokenizes each field, positions carry on from field to field with a gap between them.
+// It doesn't touch the model so pages are tokenized without holding the ModelLock
+func analyzeFields(fields [NumFields]string) analyzedFields {
+	analyzed := analyzedFields{
+		tf:         make(TermFreq),
+		positions:  make(map[string][]int),
+		fieldFreqs: make(map[string][NumFields]int),
+	}
+
+	position := 0
+	for field, content := range fields {
+		fieldLexer := lexer.NewLexer(content)
+		for {
+			token, err := fieldLexer.Next()
+			if err != nil {
+				break
+			}
+
+			analyzed.tf[token] += 1
+			analyzed.positions[token] = append(analyzed.positions[token], position)
+			freqs := analyzed.fieldFreqs[token]
+			freqs[field] += 1
+			analyzed.fieldFreqs[token] = freqs
+			analyzed.fieldLengths[field] += 1
+			position++
+		}
+		if analyzed.fieldLengths[field] > 0 {
+			position += fieldPositionGap
+		}
+	}
+	return analyzed
+}
+
+// This function adds an analyzed document to the postings, DF and field lengths of the model.
+// The caller must hold the ModelLock
+func addFields(path string, analyzed analyzedFields, model *Model) {
+	docData := ConvertToDocData(analyzed.tf)
+	docData.FieldLengths = analyzed.fieldLengths
+
+	for token := range analyzed.tf {
+		model.TermCount += 1
+		model.DF[token] += 1
+		addPosting(model.Postings, token, path, Posting{
+			Freq:       len(analyzed.positions[token]),
+			Positions:  analyzed.positions[token],
+			FieldFreqs: analyzed.fieldFreqs[token],
+		})
+	}
+	for field, length := range analyzed.fieldLengths {
+		model.FieldLengths[field] += length
+	}
+	model.TFPD[path] = docData
+}
+
+// This function returns the average length of each field across the documents in the model.
+// The caller must hold the ModelLock
+func averageFieldLengths(model *Model) [NumFields]float32 {
+	var averages [NumFields]float32
+	if len(model.TFPD) == 0 {
+		return averages
+	}
+	for field, length := range model.FieldLengths {
+		averages[field] = float32(length) / float32(len(model.TFPD))
+	}
+	return averages
+}
+
+// This function returns the average total number of terms in a document, the sum of the average field lengths.
+// It is the average a document's TermCount is normalised by, DA averages the distinct terms of each document instead
+func averageDocLength(averages [NumFields]float32) float32 {
+	var total float32
+	for _, average := range averages {
+		total += average
+	}
+	return total
+}
@@ -0,0 +1,149 @@
+package bm25
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//CurrentFileName is the file in an index directory naming the generation that is loaded
+	CurrentFileName = "CURRENT"
+	//generationPrefix starts the name of every generation directory
+	generationPrefix = "gen-"
+)
+
+// This function returns the name of a new index generation, names sort in the order they were created
+func NewGeneration() string {
+	return generationPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// This function writes a file by writing to a temporary file in the same directory, syncing it and renaming it
+// over the target, so a crash leaves either the old or the new file and never a partial one
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filePath)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	//Remove the temporary file if anything fails before the rename
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return err
+	}
+	committed = true
+
+	//Sync the directory so the rename itself survives a crash, not every platform supports it
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// This function makes a fully written generation the one that is loaded by atomically replacing the CURRENT file.
+// The generation it replaces is kept, other generations started before this one are removed, whether they were
+// committed before it or abandoned by a crawl that never finished
+func CommitGeneration(dirName string, generation string) error {
+	//Only the generation named by CURRENT is the previous one, an abandoned generation may sort after it
+	previous := ""
+	if previousDir, err := ResolveIndexDir(dirName); err == nil && previousDir != dirName {
+		previous = path.Base(previousDir)
+	}
+
+	if err := writeFileAtomic(path.Join(dirName, CurrentFileName), []byte(generation+"\n"), 0644); err != nil {
+		return fmt.Errorf("error committing index generation %s: %v", generation, err)
+	}
+
+	entries, err := os.ReadDir(dirName)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	//The previous generation is kept as a reader may still be loading it, generations started after this one
+	//belong to a crawl that is still running
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, generationPrefix) || name >= generation || name == previous {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(dirName, name)); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// This function returns the directory holding the files of the current generation of an index,
+// indexes written before generations existed keep their files in the index directory itself
+func ResolveIndexDir(dirPath string) (string, error) {
+	data, err := os.ReadFile(path.Join(dirPath, CurrentFileName))
+	if os.IsNotExist(err) {
+		return dirPath, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	generation := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(generation, generationPrefix) || strings.ContainsAny(generation, `/\`) {
+		return "", fmt.Errorf("%s names an invalid generation %q", CurrentFileName, generation)
+	}
+	return path.Join(dirPath, generation), nil
+}
+
+// This function returns the generations of an index that were started after the current one but never committed,
+// newest first. They are left behind by crawls that were interrupted
+func PendingGenerations(dirName string) ([]string, error) {
+	currentDir, err := ResolveIndexDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	current := ""
+	if currentDir != dirName {
+		current = path.Base(currentDir)
+	}
+
+	entries, err := os.ReadDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	generations := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), generationPrefix) && entry.Name() > current {
+			generations = append(generations, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(generations)))
+	return generations, nil
+}
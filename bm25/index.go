@@ -0,0 +1,150 @@
+package bm25
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/deanrtaylor1/gosearch/util"
+)
+
+const (
+	//IndexFileName is the file the computed term statistics of an index are stored in
+	IndexFileName = "index.gz"
+	//DocumentsFileName is the file the raw content of the crawled pages is stored in, used for snippets and reindexing
+	DocumentsFileName = "indexed-data.gz"
+)
+
+// IndexData is the computed part of a model as it is stored on disk, loading it is a decode rather than a re-index
+type IndexData struct {
+	TFPD         TermFreqPerDoc
+	DF           DocFreq
+	Postings     InvertedIndex
+	FieldLengths [NumFields]int
+	TermCount    int
+	DocCount     int
+	//Pages is missing from indexes written before incremental re-crawls
+	Pages map[string]PageMeta
+}
+
+// This function writes the computed index of the model so it can be loaded without tokenizing the documents again,
+// it returns a manifest with the counts of what was written
+func WriteIndex(model *Model, fileOps FileOps, dirName string) (Manifest, error) {
+	//The lock is held while encoding as pages still being crawled write to the same maps
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+
+	manifest := Manifest{
+		DocCount:    model.DocCount,
+		TermCount:   model.TermCount,
+		UniqueTerms: len(model.DF),
+	}
+	return manifest, fileOps.CompressAndWriteGzipFile(IndexFileName, IndexData{
+		TFPD:         model.TFPD,
+		DF:           model.DF,
+		Postings:     model.Postings,
+		FieldLengths: model.FieldLengths,
+		TermCount:    model.TermCount,
+		DocCount:     model.DocCount,
+		Pages:        model.Pages,
+	}, dirName)
+}
+
+// This function reads and decodes a gzip compressed gob file into data
+func readGzipGob(filePath string, data interface{}) error {
+	compressedData, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressedData))
+	if err != nil {
+		return fmt.Errorf("error decompressing %s: %v", path.Base(filePath), err)
+	}
+	defer gzipReader.Close()
+
+	if err := gob.NewDecoder(gzipReader).Decode(data); err != nil {
+		return fmt.Errorf("error decoding %s: %v", path.Base(filePath), err)
+	}
+	return nil
+}
+
+// This function loads the computed index of a directory into the model
+func readIndexFile(dirPath string, model *Model) error {
+	var index IndexData
+	if err := readGzipGob(path.Join(dirPath, IndexFileName), &index); err != nil {
+		return err
+	}
+
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+	model.TFPD = index.TFPD
+	model.DF = index.DF
+	model.Postings = index.Postings
+	model.FieldLengths = index.FieldLengths
+	model.TermCount = index.TermCount
+	model.DocCount = index.DocCount
+	model.DirLength = float32(index.DocCount)
+	model.Pages = index.Pages
+	//gob leaves maps that were empty when encoded as nil
+	if model.TFPD == nil {
+		model.TFPD = make(TermFreqPerDoc)
+	}
+	if model.DF == nil {
+		model.DF = make(DocFreq)
+	}
+	if model.Postings == nil {
+		model.Postings = make(InvertedIndex)
+	}
+	if model.Pages == nil {
+		model.Pages = make(map[string]PageMeta)
+	}
+	return nil
+}
+
+// This function loads the stored content of the documents without indexing it, used alongside the computed index
+func readDocumentsFile(dirPath string, model *Model) error {
+	var documents map[string]util.IndexedData
+	if err := readGzipGob(path.Join(dirPath, DocumentsFileName), &documents); err != nil {
+		return err
+	}
+
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+	for filePath, doc := range documents {
+		doc.URL = filePath
+		model.Documents[filePath] = doc
+	}
+	return nil
+}
+
+// This function loads the computed index and stored documents written by a crawl checkpoint into the model, the url
+// files and ranking of the crawl are restored by the crawler
+func LoadCheckpointIndex(dirPath string, model *Model) error {
+	loaded := NewEmptyModel()
+	if err := readIndexFile(dirPath, loaded); err != nil {
+		return err
+	}
+	store, err := OpenSegmentStore(dirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+	model.TFPD = loaded.TFPD
+	model.DF = loaded.DF
+	model.Postings = loaded.Postings
+	model.FieldLengths = loaded.FieldLengths
+	model.TermCount = loaded.TermCount
+	model.DocCount = loaded.DocCount
+	model.DirLength = loaded.DirLength
+	model.Pages = loaded.Pages
+	model.Documents = make(map[string]util.IndexedData)
+	model.DocStore = store
+	updateDA(model)
+	return nil
+}
@@ -0,0 +1,156 @@
+package bm25
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	//ManifestFileName is the file describing the format and contents of an index directory
+	ManifestFileName = "manifest.json"
+	//ManifestVersion is the version of the on-disk index format written by this build
+	ManifestVersion = 1
+
+	UrlFilesFileName        = "url-files.gz"
+	ReverseUrlFilesFileName = "reverse-url-files.gz"
+)
+
+// manifestFiles are the data files of an index that are checksummed when they were written, ranking.json is left
+// out as it is edited through the API after the index is written. The documents-*.gz segment files are added to these
+var manifestFiles = []string{IndexFileName, DocumentsFileName, SegmentIndexFileName, UrlFilesFileName, ReverseUrlFilesFileName, CrawlReportFileName, FailedURLsFileName}
+
+// CrawlSettings are the settings the crawl that produced an index was run with
+type CrawlSettings struct {
+	URLLimit          int      `json:"url_limit"`
+	Concurrency       int      `json:"concurrency,omitempty"`
+	RequestsPerSecond float64  `json:"requests_per_second,omitempty"`
+	Timeout           string   `json:"timeout,omitempty"`
+	Include           []string `json:"include,omitempty"`
+	Exclude           []string `json:"exclude,omitempty"`
+	MaxDepth          int      `json:"max_depth,omitempty"`
+	AllowedHosts      []string `json:"allowed_hosts,omitempty"`
+}
+
+// ManifestFile is the size and sha256 checksum of a file in an index directory
+type ManifestFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest records the format version, origin and contents of an index directory so it can be verified on load
+type Manifest struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	SourceURL string        `json:"source_url"`
+	Crawl     CrawlSettings `json:"crawl"`
+	//Partial is set when the crawl was cancelled before it finished
+	Partial  bool `json:"partial,omitempty"`
+	DocCount int  `json:"doc_count"`
+	//TermCount is the number of document term pairs and UniqueTerms the number of distinct terms
+	TermCount   int                     `json:"term_count"`
+	UniqueTerms int                     `json:"unique_terms"`
+	Files       map[string]ManifestFile `json:"files"`
+}
+
+// This function checksums the data files in the directory and writes the manifest next to them,
+// it should be written last so a manifest only exists for a complete index
+func WriteManifest(manifest Manifest, dirName string) error {
+	manifest.Version = ManifestVersion
+	manifest.Files = make(map[string]ManifestFile)
+	segments, err := segmentFiles(dirName)
+	if err != nil {
+		return err
+	}
+	for _, fileName := range append(manifestFiles, segments...) {
+		file, err := checksumFile(path.Join(dirName, fileName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error checksumming %s: %v", fileName, err)
+		}
+		manifest.Files[fileName] = file
+	}
+
+	return WriteJSONFile(ManifestFileName, manifest, dirName)
+}
+
+// This function returns the size and sha256 checksum of a file
+func checksumFile(filePath string) (ManifestFile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// This function reads the manifest of an index directory, indexes written before manifests existed return nil
+func ReadManifest(dirPath string) (*Manifest, error) {
+	data, err := os.ReadFile(path.Join(dirPath, ManifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", ManifestFileName, err)
+	}
+	return &manifest, nil
+}
+
+// This function checks that the index format is supported and that every file listed in the manifest
+// exists with the recorded size and checksum
+func (m *Manifest) Verify(dirPath string) error {
+	if m.Version < 1 || m.Version > ManifestVersion {
+		return fmt.Errorf("index format version %d is not supported, this build reads up to version %d", m.Version, ManifestVersion)
+	}
+	if _, ok := m.Files[IndexFileName]; !ok {
+		return fmt.Errorf("%s does not list %s", ManifestFileName, IndexFileName)
+	}
+
+	for fileName, expected := range m.Files {
+		actual, err := checksumFile(path.Join(dirPath, fileName))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s is listed in %s but missing", fileName, ManifestFileName)
+		}
+		if err != nil {
+			return fmt.Errorf("error checksumming %s: %v", fileName, err)
+		}
+		if actual.Size != expected.Size {
+			return fmt.Errorf("%s is %d bytes, the manifest expects %d, the index is truncated or corrupt", fileName, actual.Size, expected.Size)
+		}
+		if actual.SHA256 != expected.SHA256 {
+			return fmt.Errorf("%s does not match its checksum in %s, the index is corrupt", fileName, ManifestFileName)
+		}
+	}
+	return nil
+}
+
+// This function checks the current generation of an index directory before it is loaded, indexes without a manifest can't be verified
+func VerifyIndex(dirPath string) error {
+	dirPath, err := ResolveIndexDir(dirPath)
+	if err != nil {
+		return err
+	}
+	manifest, err := ReadManifest(dirPath)
+	if err != nil || manifest == nil {
+		return err
+	}
+	return manifest.Verify(dirPath)
+}
@@ -0,0 +1,74 @@
+package bm25
+
+import (
+	"sort"
+
+	"github.com/deanrtaylor1/gosearch/query"
+)
+
+// This function finds the documents containing the phrase and returns their sloppy phrase frequency,
+// each occurrence adds 1/(1+distance) where distance is how far the terms are from an exact phrase.
+// The caller must hold the ModelLock
+func MatchPhrase(model *Model, phrase query.Phrase) map[string]float32 {
+	matches := make(map[string]float32)
+	if len(phrase.Terms) == 0 {
+		return matches
+	}
+
+	//Start from the rarest term so the fewest candidate documents are checked
+	rarest := model.Postings[phrase.Terms[0]]
+	for _, token := range phrase.Terms[1:] {
+		if len(model.Postings[token]) < len(rarest) {
+			rarest = model.Postings[token]
+		}
+	}
+
+	for path := range rarest {
+		positions := make([][]int, len(phrase.Terms))
+		for i, token := range phrase.Terms {
+			posting, ok := model.Postings[token][path]
+			if !ok {
+				positions = nil
+				break
+			}
+			positions[i] = posting.Positions
+		}
+		if positions == nil {
+			continue
+		}
+
+		if freq := phraseFrequency(positions, phrase.Slop); freq > 0 {
+			matches[path] = freq
+		}
+	}
+	return matches
+}
+
+// This function anchors on each position of the first term and finds the closest position of every following
+// term to where it would sit in an exact phrase, occurrences within the slop are counted weighted by distance
+func phraseFrequency(positions [][]int, slop int) float32 {
+	var freq float32
+	for _, anchor := range positions[0] {
+		distance := 0
+		for i := 1; i < len(positions) && distance <= slop; i++ {
+			distance += nearestDistance(positions[i], anchor+i)
+		}
+		if distance <= slop {
+			freq += 1 / float32(1+distance)
+		}
+	}
+	return freq
+}
+
+// This function returns the distance from target to the closest value in the ascending positions
+func nearestDistance(positions []int, target int) int {
+	i := sort.SearchInts(positions, target)
+	best := -1
+	if i < len(positions) {
+		best = positions[i] - target
+	}
+	if i > 0 && (best < 0 || target-positions[i-1] < best) {
+		best = target - positions[i-1]
+	}
+	return best
+}
@@ -0,0 +1,183 @@
+package bm25
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// Variant is the formula used to turn term statistics into a bm25 score
+type Variant string
+
+const (
+	//VariantBM25 is the classic Okapi bm25 formula
+	VariantBM25 Variant = "bm25"
+	//VariantBM25Plus adds delta to every matching term so long documents are not ranked below documents without the term
+	VariantBM25Plus Variant = "bm25+"
+	//VariantBM25L shifts the length normalised frequency by delta, favouring long documents less harshly
+	VariantBM25L Variant = "bm25l"
+)
+
+// RankingFileName is the file the ranking configuration of an index is stored in
+const RankingFileName = "ranking.json"
+
+// RankingConfig holds the parameters of the bm25 formula, each index stores its own
+type RankingConfig struct {
+	Variant Variant `json:"variant"`
+	//K1 controls how quickly repeating a term stops adding to the score
+	K1 float32 `json:"k1"`
+	//B controls how much the document length normalises the term frequency (0 none, 1 full)
+	B float32 `json:"b"`
+	//Delta is the lower bound added to a matching term by BM25+ and the frequency shift of BM25L
+	Delta        float32      `json:"delta"`
+	FieldWeights FieldWeights `json:"field_weights"`
+}
+
+// DefaultRankingConfig is the configuration of a new model
+var DefaultRankingConfig = RankingConfig{
+	Variant:      VariantBM25,
+	K1:           1.2,
+	B:            0.75,
+	Delta:        1,
+	FieldWeights: DefaultFieldWeights,
+}
+
+// This function looks up a variant by name e.g. "bm25+", bm25plus is accepted as + is a space in a url query
+func ParseVariant(name string) (Variant, error) {
+	switch Variant(strings.ToLower(name)) {
+	case VariantBM25:
+		return VariantBM25, nil
+	case VariantBM25Plus, "bm25plus":
+		return VariantBM25Plus, nil
+	case VariantBM25L:
+		return VariantBM25L, nil
+	}
+	return "", fmt.Errorf("unknown bm25 variant %q, expected one of bm25, bm25+ or bm25l", name)
+}
+
+// This function checks that the variant is known and the parameters are in range
+func (c RankingConfig) Validate() error {
+	switch c.Variant {
+	case VariantBM25, VariantBM25Plus, VariantBM25L:
+	default:
+		return fmt.Errorf("unknown bm25 variant %q, expected one of bm25, bm25+ or bm25l", c.Variant)
+	}
+	//NaN fails every comparison, so the bounds below can't catch it
+	if !finite(c.K1) || c.K1 < 0 {
+		return fmt.Errorf("k1 must be a non negative number, got %v", c.K1)
+	}
+	if !finite(c.B) || c.B < 0 || c.B > 1 {
+		return fmt.Errorf("b must be between 0 and 1, got %v", c.B)
+	}
+	if !finite(c.Delta) || c.Delta < 0 {
+		return fmt.Errorf("delta must be a non negative number, got %v", c.Delta)
+	}
+	for field, weight := range c.FieldWeights {
+		if !finite(weight) || weight < 0 {
+			return fmt.Errorf("the %s weight must be a non negative number, got %v", FieldNames[field], weight)
+		}
+	}
+	return nil
+}
+
+// This function reports whether a value is a number other than infinity
+func finite(value float32) bool {
+	return !math.IsNaN(float64(value)) && !math.IsInf(float64(value), 0)
+}
+
+// This function normalises a frequency by the length of the document (or field) relative to the average
+func (c RankingConfig) normalise(freq float32, length int, average float32) float32 {
+	if average == 0 {
+		return freq
+	}
+	return freq / (1 - c.B + (c.B * (float32(length) / average)))
+}
+
+// This function saturates a length normalised frequency with the formula of the variant
+func (c RankingConfig) saturate(tf float32) float32 {
+	if tf <= 0 {
+		return 0
+	}
+	switch c.Variant {
+	case VariantBM25Plus:
+		return tf*(c.K1+1)/(tf+c.K1) + c.Delta
+	case VariantBM25L:
+		return (c.K1 + 1) * (tf + c.Delta) / (c.K1 + tf + c.Delta)
+	}
+	return tf * (c.K1 + 1) / (tf + c.K1)
+}
+
+// Compute the TF component from the frequency of a term (or phrase) in a document of n terms
+func (c RankingConfig) TF(freq float32, n int, DA float32) float32 {
+	return c.saturate(c.normalise(freq, n, DA))
+}
+
+// Compute the IDF of a term with the formula of the variant
+func (c RankingConfig) IDF(t string, N int, df DocFreq) float32 {
+	switch c.Variant {
+	case VariantBM25Plus:
+		if df[t] == 0 {
+			return 0
+		}
+		return float32(math.Log10(float64(N+1) / float64(df[t])))
+	case VariantBM25L:
+		return float32(math.Log10(float64(N+1) / (float64(df[t]) + 0.5)))
+	}
+
+	M := float64(df[t]) + 0.5
+	n := math.Max(float64(N)-float64(df[t])+0.5, M)
+	return float32(math.Log10(n / M))
+}
+
+// Compute the BM25F TF component of a term in a document, the frequency in each field is normalised by the
+// length of that field and weighted before a single saturation so repeating a term across fields has diminishing returns
+func (c RankingConfig) ComputeBM25F(posting Posting, doc DocData, averages [NumFields]float32) float32 {
+	var weighted float32
+	for field, freq := range posting.FieldFreqs {
+		if freq == 0 || averages[field] == 0 {
+			continue
+		}
+		weighted += c.FieldWeights[field] * c.normalise(float32(freq), doc.FieldLengths[field], averages[field])
+	}
+	return c.saturate(weighted)
+}
+
+// This function writes the ranking configuration of an index so it is used again when the index is loaded,
+// it is saved with the current generation of the index
+func SaveRankingConfig(dirPath string, config RankingConfig) error {
+	dirPath, err := ResolveIndexDir(dirPath)
+	if err != nil {
+		return err
+	}
+	return WriteJSONFile(RankingFileName, config, dirPath)
+}
+
+// This function reads the ranking configuration of an index, indexes without one use the defaults
+func readRankingConfig(dirPath string, model *Model) error {
+	data, err := os.ReadFile(path.Join(dirPath, RankingFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	config := DefaultRankingConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("error decoding %s: %v", RankingFileName, err)
+	}
+	if config.Variant, err = ParseVariant(string(config.Variant)); err != nil {
+		return fmt.Errorf("invalid %s: %v", RankingFileName, err)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid %s: %v", RankingFileName, err)
+	}
+
+	model.ModelLock.Lock()
+	model.Ranking = config
+	model.ModelLock.Unlock()
+	return nil
+}
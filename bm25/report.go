@@ -0,0 +1,49 @@
+package bm25
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+const (
+	//CrawlReportFileName is the file the outcome of every url of the crawl that wrote an index is stored in
+	CrawlReportFileName = "crawl-report.json"
+	//FailedURLsFileName is the file in an index generation listing the urls that couldn't be crawled
+	FailedURLsFileName = "failed-urls.json"
+)
+
+// PageOutcome is what happened to a url the crawler tried to index, kept so a crawl can be reported on
+type PageOutcome struct {
+	//Outcome is why the page was or wasn't indexed, such as indexed, http_error or unsupported_type
+	Outcome     string `json:"outcome"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	//Charset is the encoding an indexed page was decoded from
+	Charset string `json:"charset,omitempty"`
+	Error   string `json:"error,omitempty"`
+	//Attempts is the number of requests sent for a page that failed, including retries
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// This function loads the crawl report of an index directory into the model, indexes written before crawl reports
+// existed have none
+func readCrawlReport(dirPath string, model *Model) error {
+	data, err := os.ReadFile(path.Join(dirPath, CrawlReportFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	outcomes := make(map[string]PageOutcome)
+	if err := json.Unmarshal(data, &outcomes); err != nil {
+		return fmt.Errorf("error decoding %s: %v", CrawlReportFileName, err)
+	}
+	model.ModelLock.Lock()
+	model.Outcomes = outcomes
+	model.ModelLock.Unlock()
+	return nil
+}
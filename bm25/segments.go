@@ -0,0 +1,381 @@
+package bm25
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/deanrtaylor1/gosearch/util"
+)
+
+const (
+	//SegmentIndexFileName maps every stored document to the segment file holding it
+	SegmentIndexFileName = "segments.gz"
+	//segmentPattern names the segment files, numbered in the order they were written
+	segmentPattern = "documents-%06d.gz"
+	//DefaultSegmentSize is the number of encoded bytes after which a segment is closed and the next one started
+	DefaultSegmentSize = 4 << 20
+)
+
+// ErrWriterClosed is returned when a document is added after the writer was closed
+var ErrWriterClosed = errors.New("document writer is closed")
+
+// DocumentWriter streams the stored content of crawled pages to disk as they are indexed
+type DocumentWriter interface {
+	Add(doc util.IndexedData) error
+	//Contains reports whether a document has already been written
+	Contains(path string) bool
+	//Get reads documents that have been written, so the pages of a crawl in progress aren't also held in memory
+	Get(paths []string) (map[string]util.IndexedData, error)
+	//Flush closes the current segment and writes the segment index, so the documents written so far can be read
+	//if the crawl is interrupted
+	Flush() error
+	Close() error
+}
+
+// noOpDocumentWriter discards every document, used with FileOpsNoOp
+type noOpDocumentWriter struct{}
+
+func (w noOpDocumentWriter) Add(doc util.IndexedData) error { return nil }
+
+func (w noOpDocumentWriter) Contains(path string) bool { return false }
+
+func (w noOpDocumentWriter) Get(paths []string) (map[string]util.IndexedData, error) {
+	return map[string]util.IndexedData{}, nil
+}
+
+func (w noOpDocumentWriter) Flush() error { return nil }
+
+func (w noOpDocumentWriter) Close() error { return nil }
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += n
+	return n, err
+}
+
+// SegmentWriter writes documents as a gob stream into gzip compressed segment files of at most maxSize encoded bytes,
+// so only the documents of the open segment are held in memory
+type SegmentWriter struct {
+	dirName string
+	maxSize int
+	//index maps each document to the segment it was written to
+	index map[string]string
+	//pending are the documents of the open segment, it can't be read until it is closed
+	pending map[string]util.IndexedData
+	segment int
+	file    *os.File
+	gzip    *gzip.Writer
+	counter *countingWriter
+	encoder *gob.Encoder
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// This function returns a writer for the segments of an index directory, files are only created once a document is added
+func NewSegmentWriter(dirName string, maxSize int) *SegmentWriter {
+	return &SegmentWriter{dirName: dirName, maxSize: maxSize, index: make(map[string]string), pending: make(map[string]util.IndexedData)}
+}
+
+// This function returns a writer that continues the segments of an index directory written before a crawl was
+// interrupted. Segment files that aren't in the segment index were written after it and are removed
+func OpenSegmentWriter(dirName string, maxSize int) (*SegmentWriter, error) {
+	w := NewSegmentWriter(dirName, maxSize)
+	if err := readGzipGob(path.Join(dirName, SegmentIndexFileName), &w.index); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if w.index == nil {
+		w.index = make(map[string]string)
+	}
+
+	//New documents are written after the highest segment in the index
+	for _, segment := range w.index {
+		var number int
+		if _, err := fmt.Sscanf(segment, segmentPattern, &number); err == nil && number > w.segment {
+			w.segment = number
+		}
+	}
+
+	files, err := segmentFiles(dirName)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		var number int
+		if _, err := fmt.Sscanf(file, segmentPattern, &number); err == nil && number > w.segment {
+			if err := os.Remove(path.Join(dirName, file)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w, nil
+}
+
+// This function appends a document to the current segment, starting a new one when it is full
+func (w *SegmentWriter) Add(doc util.IndexedData) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if w.file == nil {
+		if err := w.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding %s: %v", doc.URL, err)
+	}
+	w.index[doc.URL] = path.Base(w.file.Name())
+	w.pending[doc.URL] = doc
+
+	if w.counter.count >= w.maxSize {
+		return w.closeSegment()
+	}
+	return nil
+}
+
+func (w *SegmentWriter) Contains(path string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, ok := w.index[path]
+	return ok
+}
+
+// This function reads documents that have been written, from memory when they are in the open segment and from
+// their segment file otherwise
+func (w *SegmentWriter) Get(paths []string) (map[string]util.IndexedData, error) {
+	documents := make(map[string]util.IndexedData)
+	index := make(map[string]string)
+	w.mutex.Lock()
+	for _, docPath := range paths {
+		if doc, ok := w.pending[docPath]; ok {
+			documents[docPath] = doc
+		} else if segment, ok := w.index[docPath]; ok {
+			index[docPath] = segment
+		}
+	}
+	w.mutex.Unlock()
+
+	var mutex sync.Mutex
+	err := streamSegments(w.dirName, index, func(doc util.IndexedData) {
+		mutex.Lock()
+		documents[doc.URL] = doc
+		mutex.Unlock()
+	})
+	return documents, err
+}
+
+// This function closes the current segment and writes the segment index, the next document starts a new segment
+func (w *SegmentWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if w.file != nil {
+		if err := w.closeSegment(); err != nil {
+			return err
+		}
+	}
+	return CompressAndWriteGzipFile(SegmentIndexFileName, w.index, w.dirName)
+}
+
+// This function closes the last segment and writes the segment index
+func (w *SegmentWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.file != nil {
+		if err := w.closeSegment(); err != nil {
+			return err
+		}
+	}
+	return CompressAndWriteGzipFile(SegmentIndexFileName, w.index, w.dirName)
+}
+
+func (w *SegmentWriter) openSegment() error {
+	w.segment++
+	file, err := os.Create(path.Join(w.dirName, fmt.Sprintf(segmentPattern, w.segment)))
+	if err != nil {
+		return fmt.Errorf("error creating segment: %v", err)
+	}
+	w.file = file
+	w.gzip = gzip.NewWriter(file)
+	w.counter = &countingWriter{w: w.gzip}
+	//Each segment is a self contained gob stream so segments can be decoded independently
+	w.encoder = gob.NewEncoder(w.counter)
+	return nil
+}
+
+func (w *SegmentWriter) closeSegment() error {
+	file := w.file
+	w.file = nil
+	w.pending = make(map[string]util.IndexedData)
+	if err := w.gzip.Close(); err != nil {
+		file.Close()
+		return fmt.Errorf("error closing segment %s: %v", path.Base(file.Name()), err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing segment %s: %v", path.Base(file.Name()), err)
+	}
+	return file.Close()
+}
+
+// This function returns the segment files of an index directory in the order they were written
+func segmentFiles(dirPath string) ([]string, error) {
+	files, err := filepath.Glob(path.Join(dirPath, "documents-*.gz"))
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range files {
+		files[i] = filepath.Base(file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// This function decodes the documents of the segment files in parallel, handing each to fn as it is read.
+// fn is called from several goroutines at once
+func ReadSegments(dirPath string, files []string, fn func(doc util.IndexedData)) error {
+	return readSegments(dirPath, files, func(file string, doc util.IndexedData) { fn(doc) })
+}
+
+// This function decodes the segment files in parallel, handing each document and the segment it was read from to fn
+func readSegments(dirPath string, files []string, fn func(file string, doc util.IndexedData)) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(files))
+	//Bound the number of segments decompressed at once
+	sem := make(chan struct{}, runtime.NumCPU())
+
+	for _, file := range files {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			err := readSegment(path.Join(dirPath, file), func(doc util.IndexedData) { fn(file, doc) })
+			if err != nil {
+				errs <- err
+			}
+		}(file)
+	}
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// This function hands the documents of index, a map of paths to the segment holding them, to fn. Only those segments
+// are decoded and a document is only read from the segment the index gives, an older copy in another segment is skipped
+func streamSegments(dirPath string, index map[string]string, fn func(doc util.IndexedData)) error {
+	segments := make(map[string]bool)
+	for _, segment := range index {
+		segments[segment] = true
+	}
+	files := make([]string, 0, len(segments))
+	for segment := range segments {
+		files = append(files, segment)
+	}
+
+	return readSegments(dirPath, files, func(file string, doc util.IndexedData) {
+		if index[doc.URL] == file {
+			fn(doc)
+		}
+	})
+}
+
+// This function streams the documents of a single segment to fn
+func readSegment(filePath string, fn func(doc util.IndexedData)) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("error decompressing %s: %v", path.Base(filePath), err)
+	}
+	defer gzipReader.Close()
+
+	decoder := gob.NewDecoder(gzipReader)
+	for {
+		var doc util.IndexedData
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding %s: %v", path.Base(filePath), err)
+		}
+		fn(doc)
+	}
+}
+
+// SegmentStore reads the stored content of documents from the segments of an index on demand,
+// so a loaded index doesn't hold every page's text in memory
+type SegmentStore struct {
+	dirPath string
+	index   map[string]string
+}
+
+// This function opens the segments of an index directory using its segment index
+func OpenSegmentStore(dirPath string) (*SegmentStore, error) {
+	var index map[string]string
+	if err := readGzipGob(path.Join(dirPath, SegmentIndexFileName), &index); err != nil {
+		return nil, err
+	}
+	return &SegmentStore{dirPath: dirPath, index: index}, nil
+}
+
+// This function returns the number of documents in the store
+func (s *SegmentStore) Len() int {
+	return len(s.index)
+}
+
+// This function reads the documents with the given paths, only the segments holding them are decoded
+func (s *SegmentStore) Get(paths []string) (map[string]util.IndexedData, error) {
+	documents := make(map[string]util.IndexedData)
+	var mutex sync.Mutex
+	err := s.Stream(paths, func(doc util.IndexedData) {
+		mutex.Lock()
+		documents[doc.URL] = doc
+		mutex.Unlock()
+	})
+	return documents, err
+}
+
+// This function hands the documents with the given paths to fn as their segments are decoded, without collecting them.
+// fn is called from several goroutines at once
+func (s *SegmentStore) Stream(paths []string, fn func(doc util.IndexedData)) error {
+	wanted := make(map[string]string)
+	for _, docPath := range paths {
+		if segment, ok := s.index[docPath]; ok {
+			wanted[docPath] = segment
+		}
+	}
+	return streamSegments(s.dirPath, wanted, fn)
+}
@@ -0,0 +1,221 @@
+package bm25
+
+import (
+	"html"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/deanrtaylor1/gosearch/lexer"
+	"github.com/deanrtaylor1/gosearch/query"
+	"github.com/deanrtaylor1/gosearch/util"
+)
+
+const (
+	//snippetLength is the number of tokens in a snippet
+	snippetLength = 30
+	//snippetContext is the number of tokens shown before the first match of a snippet
+	snippetContext = 5
+	//maxSnippets is the most fragments returned for a single result
+	maxSnippets = 2
+)
+
+// Highlight marks a matched term in the text of a snippet, offsets are in runes
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Snippet is a fragment of a document around the query terms, HTML is the escaped text with the matches in <mark> tags
+type Snippet struct {
+	Text       string      `json:"text"`
+	Highlights []Highlight `json:"highlights"`
+	HTML       string      `json:"html"`
+}
+
+// This function adds the best matching fragments of each result's stored content to the results
+func AddSnippets(model *Model, results []ResultsMap, q query.Node) {
+	terms := make(map[string]bool)
+	for _, term := range query.Terms(q) {
+		//Punctuation from phrases would highlight every full stop in the document
+		if strings.IndexFunc(term, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) >= 0 {
+			terms[term] = true
+		}
+	}
+
+	documents := make(map[string]util.IndexedData)
+	missing := []string{}
+	model.ModelLock.Lock()
+	for _, result := range results {
+		if doc, ok := model.Documents[result.Path]; ok {
+			documents[result.Path] = doc
+		} else {
+			missing = append(missing, result.Path)
+		}
+	}
+	writer := model.DocWriter
+	store := model.DocStore
+	model.ModelLock.Unlock()
+
+	//Pages stored by the crawl in progress are read from its writer, a re-crawl's changed pages are found there first
+	if writer != nil && len(missing) > 0 {
+		written, err := writer.Get(missing)
+		if err != nil {
+			log.Println(err)
+		}
+		missing = missing[:0]
+		for _, result := range results {
+			if doc, ok := written[result.Path]; ok {
+				documents[result.Path] = doc
+			} else if _, ok := documents[result.Path]; !ok {
+				missing = append(missing, result.Path)
+			}
+		}
+	}
+
+	//Documents of a loaded index are read from its segments, only the segments holding this page of results
+	if store != nil && len(missing) > 0 {
+		stored, err := store.Get(missing)
+		if err != nil {
+			log.Println(err)
+		}
+		for docPath, doc := range stored {
+			documents[docPath] = doc
+		}
+	}
+
+	for i := range results {
+		doc, ok := documents[results[i].Path]
+		if !ok {
+			continue
+		}
+		content := doc.Content
+		if content == "" {
+			content = doc.Description
+		}
+		results[i].Snippets = BuildSnippets(content, terms)
+	}
+}
+
+// This function picks up to maxSnippets non overlapping windows of the content containing the most distinct
+// query terms, if no term is found the start of the content is used
+func BuildSnippets(content string, terms map[string]bool) []Snippet {
+	tokens := lexer.TokenizeWithOffsets(content)
+	if len(tokens) == 0 {
+		return []Snippet{}
+	}
+
+	hits := []int{}
+	for i, token := range tokens {
+		if terms[token.Value] {
+			hits = append(hits, i)
+		}
+	}
+
+	if len(hits) == 0 {
+		end := snippetLength
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		return []Snippet{newSnippet(content, tokens, 0, end, nil)}
+	}
+
+	snippets := []Snippet{}
+	used := make([]bool, len(tokens))
+	for len(snippets) < maxSnippets {
+		bestStart, bestDistinct, bestHits := -1, 0, 0
+		for _, hit := range hits {
+			start := hit - snippetContext
+			if start < 0 {
+				start = 0
+			}
+			end := start + snippetLength
+			if end > len(tokens) {
+				end = len(tokens)
+			}
+			if overlaps(used, start, end) {
+				continue
+			}
+
+			distinct := make(map[string]bool)
+			count := 0
+			for _, other := range hits {
+				if other >= start && other < end {
+					distinct[tokens[other].Value] = true
+					count++
+				}
+			}
+			if len(distinct) > bestDistinct || (len(distinct) == bestDistinct && count > bestHits) {
+				bestStart, bestDistinct, bestHits = start, len(distinct), count
+			}
+		}
+		if bestStart < 0 {
+			break
+		}
+
+		end := bestStart + snippetLength
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		for i := bestStart; i < end; i++ {
+			used[i] = true
+		}
+		snippets = append(snippets, newSnippet(content, tokens, bestStart, end, terms))
+	}
+
+	return snippets
+}
+
+// overlaps reports whether any token between start and end is already in a snippet
+func overlaps(used []bool, start int, end int) bool {
+	for i := start; i < end; i++ {
+		if used[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// This function builds the snippet of tokens[start:end], marking the tokens found in terms
+func newSnippet(content string, tokens []lexer.Token, start int, end int, terms map[string]bool) Snippet {
+	runes := []rune(content)
+	from, to := tokens[start].Start, tokens[end-1].End
+
+	var text, htmlText strings.Builder
+	//length is the number of runes written to text so far
+	length := 0
+	if start > 0 {
+		text.WriteString("…")
+		htmlText.WriteString("…")
+		length++
+	}
+
+	highlights := []Highlight{}
+	last := from
+	for _, token := range tokens[start:end] {
+		if !terms[token.Value] {
+			continue
+		}
+		between := string(runes[last:token.Start])
+		text.WriteString(between)
+		htmlText.WriteString(html.EscapeString(between))
+		length += token.Start - last
+
+		match := string(runes[token.Start:token.End])
+		highlights = append(highlights, Highlight{Start: length, End: length + token.End - token.Start})
+		text.WriteString(match)
+		htmlText.WriteString("<mark>" + html.EscapeString(match) + "</mark>")
+		length += token.End - token.Start
+		last = token.End
+	}
+	rest := string(runes[last:to])
+	text.WriteString(rest)
+	htmlText.WriteString(html.EscapeString(rest))
+
+	if end < len(tokens) {
+		text.WriteString("…")
+		htmlText.WriteString("…")
+	}
+
+	return Snippet{Text: text.String(), Highlights: highlights, HTML: htmlText.String()}
+}
@@ -0,0 +1,105 @@
+package bm25
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// SearchOptions selects the page of ranked results a search returns
+type SearchOptions struct {
+	//K is the number of results on the page, 0 or less returns every hit
+	K int
+	//Offset is the number of top ranked hits skipped before the page starts
+	Offset int
+	//Ranking overrides the ranking configuration of the model for this search when set
+	Ranking *RankingConfig
+	//Explain adds the breakdown of each score on the page to the results
+	Explain bool
+}
+
+// SearchResults is a single page of ranked results
+type SearchResults struct {
+	Results []ResultsMap
+	//Total is the number of documents that matched at least one query term
+	Total int
+	//Count is the number of postings that were scored
+	Count int
+	//MaxScore is the highest score across every hit, not just the returned page
+	MaxScore float32
+}
+
+// resultsHeap is a min-heap so the lowest ranked of the current top k sits at the root
+type resultsHeap []ResultsMap
+
+func (h resultsHeap) Len() int { return len(h) }
+
+func (h resultsHeap) Less(i, j int) bool { return rankedBelow(h[i], h[j]) }
+
+func (h resultsHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *resultsHeap) Push(x interface{}) { *h = append(*h, x.(ResultsMap)) }
+
+func (h *resultsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// rankedBelow reports whether a ranks lower than b, ties are broken by path so pages are stable
+func rankedBelow(a, b ResultsMap) bool {
+	if a.TF != b.TF {
+		return a.TF < b.TF
+	}
+	return a.Path > b.Path
+}
+
+// This function selects the requested page from the scored documents using a bounded heap of size offset+k
+// rather than sorting every hit
+func TopResults(scores map[string]float32, urlFiles map[string]string, count int, opts SearchOptions) SearchResults {
+	offset := opts.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	//The heap never needs to hold more than every hit, checking the offset first keeps offset+k from overflowing
+	size := len(scores)
+	if opts.K > 0 && offset < len(scores) && offset+opts.K < len(scores) {
+		size = offset + opts.K
+	}
+
+	var maxScore float32
+	h := make(resultsHeap, 0, size)
+	for path, rank := range scores {
+		if rank > maxScore {
+			maxScore = rank
+		}
+		if size == 0 {
+			continue
+		}
+		result := ResultsMap{Name: urlFiles[path], Path: path, TF: rank}
+		if h.Len() < size {
+			heap.Push(&h, result)
+		} else if rankedBelow(h[0], result) {
+			h[0] = result
+			heap.Fix(&h, 0)
+		}
+	}
+
+	sort.Slice(h, func(i, j int) bool {
+		return rankedBelow(h[j], h[i])
+	})
+
+	results := []ResultsMap{}
+	if offset < len(h) {
+		results = h[offset:]
+	}
+
+	return SearchResults{
+		Results:  results,
+		Total:    len(scores),
+		Count:    count,
+		MaxScore: maxScore,
+	}
+}
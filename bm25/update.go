@@ -0,0 +1,136 @@
+package bm25
+
+import (
+	"sync"
+	"time"
+
+	"github.com/deanrtaylor1/gosearch/util"
+)
+
+// PageMeta is what the crawler keeps about a page between crawls so a re-crawl can send conditional requests,
+// Links are followed when the page is unchanged and its body isn't downloaded again
+type PageMeta struct {
+	ETag         string
+	LastModified string
+	Links        []string
+	//CrawledAt is when the page was last fetched or found unchanged, compared with a sitemap's lastmod on re-crawls
+	CrawledAt time.Time
+}
+
+// This function removes a document from the model: its postings, document frequencies, term and field counts,
+// stored content, the URL maps and DocCount are updated and DA is recalculated. It reports whether the document was indexed
+func RemoveDocument(path string, model *Model) bool {
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+
+	if !removeDocument(path, model) {
+		return false
+	}
+
+	model.DocCount -= 1
+	if fileName, ok := model.UrlFiles[path]; ok {
+		delete(model.UrlFiles, path)
+		//Another page may have been given the same name since
+		if model.ReverseUrlFiles[fileName] == path {
+			delete(model.ReverseUrlFiles, fileName)
+		}
+	}
+	updateDA(model)
+	return true
+}
+
+// This function replaces the indexed content of a document, the statistics of the old version are removed first.
+// A document that wasn't indexed is added and counted in DocCount. The old version is swapped for the new one while
+// holding the ModelLock so searches never see the document missing
+func UpdateDocument(doc util.IndexedData, model *Model) {
+	analyzed := analyzeFields(documentFields(doc))
+
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+	if !removeDocument(doc.URL, model) {
+		model.DocCount += 1
+	}
+	indexDocumentLocked(doc, analyzed, model)
+	updateDA(model)
+}
+
+// This function removes the statistics of a document from the postings, DF, term and field counts of the model.
+// The caller must hold the ModelLock
+func removeDocument(path string, model *Model) bool {
+	doc, ok := model.TFPD[path]
+	if !ok {
+		return false
+	}
+
+	for token := range doc.Terms {
+		model.TermCount -= 1
+		model.DF[token] -= 1
+		if model.DF[token] <= 0 {
+			delete(model.DF, token)
+		}
+		delete(model.Postings[token], path)
+		if len(model.Postings[token]) == 0 {
+			delete(model.Postings, token)
+		}
+	}
+	for field, length := range doc.FieldLengths {
+		model.FieldLengths[field] -= length
+	}
+	delete(model.TFPD, path)
+	delete(model.Documents, path)
+	delete(model.Pages, path)
+	return true
+}
+
+// This function recalculates the average document length after the documents of the model changed.
+// The caller must hold the ModelLock
+func updateDA(model *Model) {
+	if model.DocCount <= 0 {
+		model.DA = 0
+		return
+	}
+	model.DA = float32(model.TermCount) / float32(model.DocCount)
+}
+
+// This function writes the stored content of every indexed document the writer doesn't have yet, from memory
+// or from the segments of the loaded index, so a re-crawl's new generation includes the pages that didn't change
+func CarryOverDocuments(model *Model, writer DocumentWriter) error {
+	inMemory := []util.IndexedData{}
+	stored := []string{}
+	model.ModelLock.Lock()
+	for path := range model.TFPD {
+		if writer.Contains(path) {
+			continue
+		}
+		if doc, ok := model.Documents[path]; ok {
+			inMemory = append(inMemory, doc)
+		} else {
+			stored = append(stored, path)
+		}
+	}
+	store := model.DocStore
+	model.ModelLock.Unlock()
+
+	for _, doc := range inMemory {
+		if err := writer.Add(doc); err != nil {
+			return err
+		}
+	}
+	if store == nil || len(stored) == 0 {
+		return nil
+	}
+
+	var addErr error
+	var mutex sync.Mutex
+	err := store.Stream(stored, func(doc util.IndexedData) {
+		if err := writer.Add(doc); err != nil {
+			mutex.Lock()
+			addErr = err
+			mutex.Unlock()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return addErr
+}
@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
@@ -12,6 +14,7 @@ import (
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/deanrtaylor1/gosearch/bm25"
+	"github.com/deanrtaylor1/gosearch/query"
 	"github.com/deanrtaylor1/gosearch/tfidf"
 	"github.com/deanrtaylor1/gosearch/util"
 	webcrawler "github.com/deanrtaylor1/gosearch/web-crawler"
@@ -20,6 +23,31 @@ import (
 
 //CLI Interface of GoSearch
 
+// Options are the command line flags of the cli subcommand
+type Options struct {
+	//Explain prints the breakdown of each result's score
+	Explain bool
+	//Crawl are the settings new crawls are run with
+	Crawl webcrawler.CrawlOptions
+}
+
+// options are the flags the CLI was started with
+var options Options
+
+// crawlJob is the crawl running in the background, nil if none was started
+var crawlJob *webcrawler.CrawlJob
+
+// This function cancels the running crawl, if there is one, and waits for the pages crawled so far to be saved
+func cancelCrawl() {
+	if !crawlJob.Running() {
+		return
+	}
+	log.Println(util.TerminalYellow, "Cancelling the crawl of", crawlJob.URL, util.TerminalReset)
+	if err := crawlJob.Cancel(); err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(util.TerminalRed, err, util.TerminalReset)
+	}
+}
+
 // Utility function to show the user the current status of the indexing and crawling processes
 func logStatus(indexing, crawling bool, model *bm25.Model) {
 	indexState := "✓"
@@ -67,7 +95,8 @@ func GetNewWebsitePrompt() string {
 }
 
 // Start the CLI
-func InitialPrompt(model *bm25.Model) {
+func InitialPrompt(model *bm25.Model, opts Options) {
+	options = opts
 	files, err := os.ReadDir("./indexes")
 	if err != nil {
 		log.Fatal(err)
@@ -109,7 +138,10 @@ func InitialPrompt(model *bm25.Model) {
 		model.Name = selectedIndex
 		go func() {
 			logStatus(true, false, model)
-			bm25.LoadCachedGobToModel("./indexes/"+selectedIndex, model)
+			if err := bm25.LoadCachedGobToModel("./indexes/"+selectedIndex, model); err != nil {
+				log.Println(util.TerminalRed, err, util.TerminalReset)
+				return
+			}
 			model.ModelLock.Lock()
 			model.DA = float32(model.TermCount) / float32(model.DocCount)
 			model.IsComplete = true
@@ -136,11 +168,14 @@ func StartQueryPrompt(model *bm25.Model) {
 		log.Fatal(err)
 	}
 
-	startQuery(query, model)
+	startQuery(query, 0, model)
 }
 
-// Start the query process
-func startQuery(query string, model *bm25.Model) {
+// Number of results shown on each page of the results prompt
+const pageSize = 20
+
+// Start the query process, offset selects the page of results to show
+func startQuery(userQuery string, offset int, model *bm25.Model) {
 
 	start := time.Now()
 	stemmer, err := snowball.New("english")
@@ -150,55 +185,53 @@ func startQuery(query string, model *bm25.Model) {
 
 	defer stemmer.Close()
 
-	query = strings.ToLower(query)
-	var count int
-	result, count := bm25.CalculateBm25(model, query)
-
-	var max int
-	if len(result) < 20 {
-		max = len(result)
-	} else {
-		max = 20
-	}
-
-	// for i := 0; i < max; i++ {
-	// 	log.Println(result[i].Path, " => ", result[i].TF)
-	// }
-
+	q, err := query.Parse(userQuery)
 	if err != nil {
-		log.Println(err)
+		log.Println(util.TerminalRed, "Invalid query:", err, util.TerminalReset)
+		StartQueryPrompt(model)
 		return
 	}
 
-	if result[0].TF == 0 {
-		log.Println("Query too generic, ranking with tf-idf")
-
-		result, count = tfidf.CalculateTfidf(model, query)
+	opts := bm25.SearchOptions{K: pageSize, Offset: offset, Explain: options.Explain}
+	results := bm25.CalculateBm25(model, q, opts)
 
-		// for i := 0; i < max; i++ {
-		// 	log.Println(result[i].Path, " => ", result[i].TF)
-		// }
+	if results.Total > 0 && results.MaxScore == 0 {
+		log.Println("Query too generic, ranking with tf-idf")
 
+		results = tfidf.CalculateTfidf(model, q, opts)
 	}
+	count := results.Count
 
 	var data []bm25.ResultsMap
 
-	if result[0].TF == 0 {
+	if results.MaxScore == 0 {
 		data = []bm25.ResultsMap{{
 			Path: "No results found",
 			TF:   0,
 		}}
 	} else {
-		data = bm25.FilterResults(result[:max], bm25.IsGreaterThanZero)
+		data = bm25.FilterResults(results.Results, bm25.IsGreaterThanZero)
+		bm25.AddSnippets(model, data, q)
 	}
 
 	resultsList := []string{}
 	for _, r := range data {
 		resultsList = append(resultsList, "○ "+r.Name)
+		printSnippets(r)
+		printExplanation(r)
+	}
+	if offset+pageSize < results.Total {
+		resultsList = append(resultsList, "○ GoSearch: Next Page")
+	}
+	if offset > 0 {
+		resultsList = append(resultsList, "○ GoSearch: Previous Page")
 	}
 	resultsList = append(resultsList, "○ GoSearch: New Query")
 	resultsList = append(resultsList, "○ GoSearch: Select Index")
 	resultsList = append(resultsList, "○ GoSearch: Crawl and Index")
+	if crawlJob.Running() {
+		resultsList = append(resultsList, "○ GoSearch: Cancel Crawl")
+	}
 
 	prompt := &survey.Select{
 		Message: "Results:",
@@ -208,6 +241,7 @@ func startQuery(query string, model *bm25.Model) {
 
 	log.Println("------------------------------------")
 	log.Println(util.TerminalCyan+"Queried ", count, " documents in ", elapsed.Milliseconds(), " ms"+util.TerminalReset)
+	log.Printf("Showing %d-%d of %d results\n", offset+1, offset+len(data), results.Total)
 	log.Println("------------------------------------")
 
 	model.ModelLock.Lock()
@@ -224,13 +258,23 @@ func startQuery(query string, model *bm25.Model) {
 	}
 
 	switch selectedLink {
+	case "○ GoSearch: Next Page":
+		startQuery(userQuery, offset+pageSize, model)
+	case "○ GoSearch: Previous Page":
+		startQuery(userQuery, offset-pageSize, model)
 	case "○ GoSearch: New Query":
 		StartQueryPrompt(model)
 	case "○ GoSearch: Select Index":
-		InitialPrompt(model)
+		//Loading another index resets the model the crawl is writing to
+		cancelCrawl()
+		InitialPrompt(model, options)
 	case "○ GoSearch: Crawl and Index":
+		cancelCrawl()
 		newSite := GetNewWebsitePrompt()
 		InitCrawl(newSite, model)
+	case "○ GoSearch: Cancel Crawl":
+		cancelCrawl()
+		startQuery(userQuery, offset, model)
 	default:
 		cliResponse := formatCliResponse(selectedLink)
 		model.ModelLock.Lock()
@@ -241,11 +285,60 @@ func startQuery(query string, model *bm25.Model) {
 		if fullUrl != "" {
 			openBrowser(fullUrl)
 		}
-		startQuery(query, model)
+		startQuery(userQuery, offset, model)
 	}
 
 }
 
+// Print a result with its snippets, the matched terms are highlighted in yellow
+func printSnippets(result bm25.ResultsMap) {
+	if len(result.Snippets) == 0 {
+		return
+	}
+	fmt.Println(util.TerminalCyan + result.Name + util.TerminalReset + " " + result.Path)
+	for _, snippet := range result.Snippets {
+		text := []rune(snippet.Text)
+		var highlighted strings.Builder
+		last := 0
+		for _, h := range snippet.Highlights {
+			highlighted.WriteString(string(text[last:h.Start]))
+			highlighted.WriteString(util.TerminalYellow + string(text[h.Start:h.End]) + util.TerminalReset)
+			last = h.End
+		}
+		highlighted.WriteString(string(text[last:]))
+		fmt.Println("    " + highlighted.String())
+	}
+	fmt.Println()
+}
+
+// Print the breakdown of a result's score when the CLI was started with --explain
+func printExplanation(result bm25.ResultsMap) {
+	e := result.Explanation
+	if e == nil {
+		return
+	}
+	if len(result.Snippets) == 0 {
+		fmt.Println(util.TerminalCyan + result.Name + util.TerminalReset + " " + result.Path)
+	}
+	fmt.Printf("    score %.4f (%s) | doc length %d | DA %.2f | %d documents\n", result.TF, e.Method, e.DocLength, e.DA, e.DocCount)
+	if e.Ranking != nil {
+		fmt.Printf("    variant %s | k1 %v | b %v | delta %v\n", e.Ranking.Variant, e.Ranking.K1, e.Ranking.B, e.Ranking.Delta)
+	}
+	for _, term := range e.Terms {
+		fmt.Printf("    %-20s freq %-4d df %-5d tf %.4f × idf %.4f = %.4f", term.Term, term.Freq, term.DF, term.TF, term.IDF, term.Score)
+		for _, name := range bm25.FieldNames {
+			if freq, ok := term.FieldFreqs[name]; ok {
+				fmt.Printf(" %s:%d", name, freq)
+			}
+		}
+		fmt.Println()
+	}
+	for _, phrase := range e.Phrases {
+		fmt.Printf("    %-20s phrase freq %.4f slop %d avg length %.2f boost %.4f\n", "\""+strings.Join(phrase.Terms, " ")+"\"", phrase.PhraseFreq, phrase.Slop, e.AvgDocLength, phrase.Boost)
+	}
+	fmt.Println()
+}
+
 // Open the browser to the selected link depending on OS
 func openBrowser(link string) {
 	fmt.Println(link)
@@ -280,9 +373,45 @@ func InitCrawl(domain string, model *bm25.Model) {
 		log.Println(util.TerminalRed, "Error parsing URL", util.TerminalReset)
 	}
 
-	go func() {
+	//If a crawl of the site was interrupted offer to continue it from its last checkpoint
+	resume := false
+	if webcrawler.HasCheckpoint(domain) {
+		prompt := &survey.Confirm{
+			Message: "A crawl of " + fullUrl.Host + " was interrupted, resume it where it left off?",
+			Default: true,
+		}
+		if err := survey.AskOne(prompt, &resume); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	//If the site has been indexed before offer to only refetch the pages that changed
+	recrawl := false
+	if isValid, _ := util.CheckDirIsValid("./indexes/" + fullUrl.Host); isValid && !resume {
+		prompt := &survey.Confirm{
+			Message: "An index of " + fullUrl.Host + " exists, only refetch the pages that changed?",
+			Default: true,
+		}
+		if err := survey.AskOne(prompt, &recrawl); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	crawlJob = webcrawler.StartCrawlJob(domain, func(ctx context.Context) error {
 		logStatus(true, true, model)
-		webcrawler.CrawlDomainUpdateModel(domain, model, bm25.FileOpsImpl{}, 10000)
+		var err error
+		if resume {
+			err = webcrawler.ResumeCrawl(ctx, domain, model, bm25.FileOpsImpl{}, options.Crawl.HTTP)
+		} else if recrawl {
+			err = webcrawler.RecrawlDomainUpdateModel(ctx, domain, model, bm25.FileOpsImpl{}, options.Crawl)
+		} else {
+			err = webcrawler.CrawlDomainUpdateModel(ctx, domain, model, bm25.FileOpsImpl{}, options.Crawl)
+		}
+		//A cancelled crawl leaves the pages crawled so far in the model, they can still be searched
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Println(util.TerminalRed, err, util.TerminalReset)
+			return err
+		}
 		model.ModelLock.Lock()
 		model.Name = fullUrl.Host
 		model.DA = float32(model.TermCount) / float32(model.DocCount)
@@ -290,7 +419,8 @@ func InitCrawl(domain string, model *bm25.Model) {
 		model.ModelLock.Unlock()
 
 		logStatus(false, false, model)
-	}()
+		return err
+	})
 
 	StartQueryPrompt(model)
 }
@@ -88,6 +88,42 @@ func (l *Lexer) Next() (string, error) {
 	return (string(token)), nil
 }
 
+// Tokenize returns every token in the content, used to lex a query once rather than per document
+func Tokenize(content string) []string {
+	tokens := []string{}
+	l := NewLexer(content)
+	for {
+		token, err := l.Next()
+		if err != nil {
+			return tokens
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+// Token is a lexed token and the rune offsets of the text it was lexed from
+type Token struct {
+	Value string
+	Start int
+	End   int
+}
+
+// TokenizeWithOffsets returns every token in the content with where it sits in the content, used to highlight matches
+func TokenizeWithOffsets(content string) []Token {
+	tokens := []Token{}
+	l := NewLexer(content)
+	total := len(l.content)
+	for {
+		l.TrimLeft()
+		start := total - len(l.content)
+		token := l.NextToken()
+		if token == nil {
+			return tokens
+		}
+		tokens = append(tokens, Token{Value: string(token), Start: start, End: total - len(l.content)})
+	}
+}
+
 // Tokenize parses a html string and returns all the links as a slice of strings
 func ParseLinks(htmlContent string) []string {
 	links := []string{}
@@ -97,7 +133,8 @@ func ParseLinks(htmlContent string) []string {
 	}
 	var f func(*html.Node)
 	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "a" {
+		//Links marked rel="nofollow" are not followed
+		if n.Type == html.ElementNode && n.Data == "a" && !hasToken(attr(n, "rel"), "nofollow") {
 			for _, a := range n.Attr {
 				if a.Key == "href" {
 					links = append(links, a.Val)
@@ -128,6 +165,113 @@ func ParseHtmlTextContent(htmlContent string) string {
 	}
 }
 
+// HtmlDocument is the text of a html page split into the fields that are indexed separately
+type HtmlDocument struct {
+	Title       string
+	Headings    string
+	Description string
+	Body        string
+	//NoIndex and NoFollow are set by a robots meta tag asking crawlers not to index the page or follow its links
+	NoIndex  bool
+	NoFollow bool
+	//Canonical is the href of <link rel="canonical">, the url the page says it is a duplicate of
+	Canonical string
+}
+
+// ParseHtmlDocument parses a html string into its title, headings (h1-h6), meta description and remaining body text,
+// script and style content is dropped and text from separate elements is separated by a space
+func ParseHtmlDocument(htmlContent string) HtmlDocument {
+	var title, headings, body strings.Builder
+	var doc HtmlDocument
+
+	nodes, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		fmt.Println(err)
+		return doc
+	}
+
+	var f func(*html.Node, *strings.Builder)
+	f = func(n *html.Node, out *strings.Builder) {
+		switch n.Type {
+		case html.TextNode:
+			text := strings.TrimSpace(n.Data)
+			if text != "" {
+				out.WriteString(text)
+				out.WriteRune(' ')
+			}
+			return
+		case html.ElementNode:
+			switch n.Data {
+			case "script", "style", "noscript", "template":
+				return
+			case "title":
+				out = &title
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				out = &headings
+			case "meta":
+				name := attr(n, "name")
+				if strings.EqualFold(name, "description") {
+					doc.Description = strings.TrimSpace(attr(n, "content"))
+				}
+				if strings.EqualFold(name, "robots") || strings.EqualFold(name, "gosearch") {
+					noIndex, noFollow := ParseRobotsDirectives(attr(n, "content"))
+					doc.NoIndex = doc.NoIndex || noIndex
+					doc.NoFollow = doc.NoFollow || noFollow
+				}
+			case "link":
+				if hasToken(attr(n, "rel"), "canonical") && doc.Canonical == "" {
+					doc.Canonical = strings.TrimSpace(attr(n, "href"))
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c, out)
+		}
+	}
+	f(nodes, &body)
+
+	doc.Title = strings.TrimSpace(title.String())
+	doc.Headings = strings.TrimSpace(headings.String())
+	doc.Body = strings.TrimSpace(body.String())
+	return doc
+}
+
+// ParseRobotsDirectives reads the noindex and nofollow directives of a robots meta tag or X-Robots-Tag header,
+// "none" means both
+func ParseRobotsDirectives(content string) (noIndex bool, noFollow bool) {
+	for _, directive := range strings.Split(content, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "noindex":
+			noIndex = true
+		case "nofollow":
+			noFollow = true
+		case "none":
+			noIndex, noFollow = true, true
+		}
+	}
+	return noIndex, noFollow
+}
+
+// hasToken reports whether a space separated attribute value such as rel contains token
+func hasToken(value string, token string) bool {
+	for _, field := range strings.Fields(value) {
+		if strings.EqualFold(field, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// attr returns the value of a html attribute or an empty string if it is missing
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
 // Utility function to sort a map by value
 func MapToSortedSlice(m map[string]int) (stats []stat) {
 	for k, v := range m {
@@ -117,6 +117,32 @@ func TestNext(t *testing.T) {
 	}
 }
 
+func TestTokenize(t *testing.T) {
+	tokens := Tokenize("Promise chaining!")
+	expected := []string{"promis", "chain", "!"}
+
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Tokenize() Failed, expected %v, got %v", expected, tokens)
+	}
+
+	if len(Tokenize("   ")) != 0 {
+		t.Errorf("Tokenize() Failed, expected no tokens for whitespace")
+	}
+}
+
+func TestTokenizeWithOffsets(t *testing.T) {
+	tokens := TokenizeWithOffsets("  Café promises!")
+	expected := []Token{
+		{Value: "café", Start: 2, End: 6},
+		{Value: "promis", Start: 7, End: 15},
+		{Value: "!", Start: 15, End: 16},
+	}
+
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("TokenizeWithOffsets() Failed, expected %v, got %v", expected, tokens)
+	}
+}
+
 func TestParseLinks(t *testing.T) {
 	testCases := []struct {
 		name          string
@@ -147,6 +173,19 @@ func TestParseLinks(t *testing.T) {
 				"/page4",
 			},
 		},
+		{
+			name: "Nofollow links",
+			htmlContent: `
+<html>
+<body>
+  <a href="/page1">Link 1</a>
+  <a href="/page2" rel="nofollow">Link 2</a>
+  <a href="/page3" rel="noopener NoFollow">Link 3</a>
+</body>
+</html>
+`,
+			expectedLinks: []string{"/page1"},
+		},
 		// Add more test cases here
 	}
 
@@ -203,6 +242,64 @@ func TestParseHtmlTextContent(t *testing.T) {
 
 }
 
+func TestParseHtmlDocument(t *testing.T) {
+	htmlContent := `
+<!DOCTYPE html>
+<html>
+<head>
+<title>Promise chaining</title>
+<meta name="Description" content="Chaining promises together">
+<link rel="canonical" href="https://javascript.info/promise-chaining">
+<style>.body { color: red; }</style>
+</head>
+<body>
+  <h1>Promises</h1>
+  <p>Returning a value from <code>then</code> passes it on.</p>
+  <h2>Errors</h2>
+  <script>console.log("ignored")</script>
+  <p>Use catch.</p>
+</body>
+</html>`
+
+	expected := HtmlDocument{
+		Title:       "Promise chaining",
+		Headings:    "Promises Errors",
+		Description: "Chaining promises together",
+		Body:        "Returning a value from then passes it on. Use catch.",
+		Canonical:   "https://javascript.info/promise-chaining",
+	}
+
+	document := ParseHtmlDocument(htmlContent)
+	if !reflect.DeepEqual(document, expected) {
+		t.Errorf("Expected: %#v, got: %#v", expected, document)
+	}
+}
+
+func TestParseRobotsMeta(t *testing.T) {
+	testCases := []struct {
+		name     string
+		meta     string
+		noIndex  bool
+		noFollow bool
+	}{
+		{name: "No directives", meta: `<meta name="robots" content="index, follow">`},
+		{name: "Noindex", meta: `<meta name="robots" content="noindex">`, noIndex: true},
+		{name: "Both", meta: `<meta name="ROBOTS" content="NOINDEX, nofollow">`, noIndex: true, noFollow: true},
+		{name: "None", meta: `<meta name="robots" content="none">`, noIndex: true, noFollow: true},
+		{name: "Crawler specific", meta: `<meta name="gosearch" content="nofollow">`, noFollow: true},
+		{name: "Other crawler", meta: `<meta name="googlebot" content="noindex">`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			document := ParseHtmlDocument("<html><head>" + tc.meta + "</head><body>text</body></html>")
+			if document.NoIndex != tc.noIndex || document.NoFollow != tc.noFollow {
+				t.Errorf("Expected noindex %v nofollow %v, got noindex %v nofollow %v", tc.noIndex, tc.noFollow, document.NoIndex, document.NoFollow)
+			}
+		})
+	}
+}
+
 func TestMapToSortedSlice(t *testing.T) {
 
 	testCases := []struct {
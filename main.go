@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"os"
 
@@ -15,19 +17,54 @@ import (
 	"github.com/deanrtaylor1/gosearch/cli"
 	"github.com/deanrtaylor1/gosearch/server"
 	"github.com/deanrtaylor1/gosearch/util"
+	webcrawler "github.com/deanrtaylor1/gosearch/web-crawler"
 )
 
+// stringList is a flag that can be repeated, each value is appended
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func help() {
 	fmt.Println("GoSearch - A simple search engine written in Go")
 	fmt.Println("Author: Dean Taylor")
 	fmt.Println("Version: 0.2")
 	fmt.Println("License: MIT")
 	fmt.Println("default start: gosearch.exe launches search engine and crawler on localhost:8080")
+	fmt.Println("    GOSEARCH_ALLOW_PROXY=true and GOSEARCH_ALLOW_INSECURE_TLS=true let API crawls set proxy and insecure_skip_verify")
 
 	fmt.Println("CLI Usage: PROGRAM [SUBCOMMAND] [OPTIONS]")
 	fmt.Println("----------------------------------")
 	fmt.Println("Subcommands:")
 	fmt.Println("    cli:                            start server with cli interface")
+	fmt.Println("        --explain                   show the breakdown of each result's score")
+	fmt.Println("        --url-limit <n>             the most pages a crawl fetches (default 10000)")
+	fmt.Println("        --concurrency <n>           the number of pages fetched at once (default 8)")
+	fmt.Println("        --rps <n>                   the most requests per second sent to a host, 0 for no limit (default 5)")
+	fmt.Println("        --timeout <duration>        how long a single request may take, e.g. 10s (default 30s)")
+	fmt.Println("        --include <pattern>         only follow links matching a glob (/docs/**) or regex (re:^/api/), can be repeated")
+	fmt.Println("        --exclude <pattern>         never follow links matching a pattern, can be repeated")
+	fmt.Println("        --max-depth <n>             the most links a page may be from the initial URL (default no limit)")
+	fmt.Println("        --allow-host <host>         another host links may lead to, *.example.com allows its subdomains")
+	fmt.Println("        --retries <n>               how many times a timed out, dropped, 429 or 503 request is retried (default 3)")
+	fmt.Println("        --retry-backoff <d>         the wait before the first retry, doubled for each one after (default 1s)")
+	fmt.Println("        --max-retry-delay <d>       the longest wait before a retry, including a Retry-After (default 30s)")
+	fmt.Println("        --max-body-size <bytes>     the most bytes of a page that are downloaded (default 10485760)")
+	fmt.Println("        --user-agent <ua>           the User-Agent requests are sent with, robots.txt is matched against it")
+	fmt.Println("        --header <name: value>      a header sent to the initial URL's host, can be repeated")
+	fmt.Println("        --cookie-file <file>        a Netscape format cookies.txt whose cookies are sent with the requests")
+	fmt.Println("        --basic-auth <user:pass>    basic auth credentials for the initial URL's host")
+	fmt.Println("        --bearer-token <token>      a bearer token for the initial URL's host")
+	fmt.Println("        --proxy <url>               the proxy requests are sent through (default HTTP_PROXY/HTTPS_PROXY)")
+	fmt.Println("        --insecure                  accept self-signed TLS certificates")
+	fmt.Println("        --checkpoint-interval <d>   how often the crawl is saved so an interrupted crawl can be resumed (default 30s)")
 	fmt.Println("    help:                           list all commands")
 
 }
@@ -119,14 +156,56 @@ func main() {
 		fmt.Println(util.TerminalCyan + "Initializing server with empty model" + util.TerminalReset)
 		model := bm25.NewEmptyModel()
 		openBrowser()
-		server.Serve(model)
+		server.Serve(model, server.OptionsFromEnv())
 	}
 	program := args[0]
 
 	switch program {
 	case "cli":
+		flags := flag.NewFlagSet("cli", flag.ExitOnError)
+		explain := flags.Bool("explain", false, "show the breakdown of each result's score")
+		crawl := webcrawler.DefaultCrawlOptions
+		flags.IntVar(&crawl.URLLimit, "url-limit", crawl.URLLimit, "the most pages a crawl fetches")
+		flags.IntVar(&crawl.Concurrency, "concurrency", crawl.Concurrency, "the number of pages fetched at once")
+		flags.Float64Var(&crawl.RequestsPerSecond, "rps", crawl.RequestsPerSecond, "the most requests per second sent to a host, 0 for no limit")
+		flags.DurationVar(&crawl.Timeout, "timeout", crawl.Timeout, "how long a single request may take")
+		flags.Var((*stringList)(&crawl.Include), "include", "only follow links matching a pattern, can be repeated")
+		flags.Var((*stringList)(&crawl.Exclude), "exclude", "never follow links matching a pattern, can be repeated")
+		flags.IntVar(&crawl.MaxDepth, "max-depth", crawl.MaxDepth, "the most links a page may be from the initial URL, 0 for no limit")
+		flags.Var((*stringList)(&crawl.AllowedHosts), "allow-host", "another host links may lead to, *.example.com allows its subdomains, can be repeated")
+		flags.IntVar(&crawl.MaxRetries, "retries", crawl.MaxRetries, "how many times a timed out, dropped, 429 or 503 request is retried")
+		flags.DurationVar(&crawl.RetryBackoff, "retry-backoff", crawl.RetryBackoff, "the wait before the first retry, doubled for each one after")
+		flags.DurationVar(&crawl.MaxRetryDelay, "max-retry-delay", crawl.MaxRetryDelay, "the longest wait before a retry, including a Retry-After")
+		flags.Int64Var(&crawl.MaxBodySize, "max-body-size", crawl.MaxBodySize, "the most bytes of a page that are downloaded")
+		flags.DurationVar(&crawl.CheckpointInterval, "checkpoint-interval", crawl.CheckpointInterval, "how often the crawl is saved so an interrupted crawl can be resumed")
+		flags.StringVar(&crawl.HTTP.UserAgent, "user-agent", "", "the User-Agent requests are sent with")
+		headers := stringList{}
+		flags.Var(&headers, "header", "a header sent with every request to the initial URL's host as \"Name: value\", can be repeated")
+		flags.StringVar(&crawl.HTTP.CookieFile, "cookie-file", "", "a Netscape format cookies.txt whose cookies are sent with the requests")
+		basicAuth := flags.String("basic-auth", "", "basic auth credentials for the initial URL's host as user:password")
+		flags.StringVar(&crawl.HTTP.BearerToken, "bearer-token", "", "a bearer token for the initial URL's host")
+		flags.StringVar(&crawl.HTTP.Proxy, "proxy", "", "the proxy requests are sent through")
+		flags.BoolVar(&crawl.HTTP.InsecureSkipVerify, "insecure", false, "accept self-signed TLS certificates")
+		flags.Parse(args[1:])
+		crawl.HTTP.Headers = make(map[string]string)
+		for _, header := range headers {
+			name, value, found := strings.Cut(header, ":")
+			if !found || strings.TrimSpace(name) == "" {
+				fmt.Println(util.TerminalRed, fmt.Sprintf("invalid header %q, expected \"Name: value\"", header), util.TerminalReset)
+				os.Exit(1)
+			}
+			crawl.HTTP.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+		if *basicAuth != "" {
+			crawl.HTTP.BasicAuthUser, crawl.HTTP.BasicAuthPassword, _ = strings.Cut(*basicAuth, ":")
+		}
+		if err := crawl.Validate(); err != nil {
+			fmt.Println(util.TerminalRed, err, util.TerminalReset)
+			os.Exit(1)
+		}
+
 		model := bm25.NewEmptyModel()
-		cli.InitialPrompt(model)
+		cli.InitialPrompt(model, cli.Options{Explain: *explain, Crawl: crawl})
 
 		// model := bm25.NewEmptyModel()
 		// if selectedDirectory == "Start server" {
@@ -0,0 +1,70 @@
+package query
+
+// Scorer scores the documents matching a single term or phrase, a scorer (bm25, tfidf) only has to know
+// how to rank the leaves of the AST and Evaluate combines them
+type Scorer interface {
+	ScoreTerm(term string) map[string]float32
+	ScorePhrase(phrase Phrase) map[string]float32
+}
+
+// This function evaluates the AST against a scorer and returns the score of every matching document
+func Evaluate(node Node, scorer Scorer) map[string]float32 {
+	switch n := node.(type) {
+	case Term:
+		return scorer.ScoreTerm(n.Value)
+	case Phrase:
+		return scorer.ScorePhrase(n)
+	case Boolean:
+		return evaluateBoolean(n, scorer)
+	}
+	return map[string]float32{}
+}
+
+func evaluateBoolean(node Boolean, scorer Scorer) map[string]float32 {
+	var required map[string]float32
+	optional := make(map[string]float32)
+	excluded := []map[string]float32{}
+
+	for _, clause := range node.Clauses {
+		scores := Evaluate(clause.Node, scorer)
+		switch clause.Occur {
+		case Must:
+			if required == nil {
+				required = scores
+				continue
+			}
+			//Only keep the documents found by every required clause
+			for path := range required {
+				if score, ok := scores[path]; ok {
+					required[path] += score
+				} else {
+					delete(required, path)
+				}
+			}
+		case Should:
+			for path, score := range scores {
+				optional[path] += score
+			}
+		case MustNot:
+			excluded = append(excluded, scores)
+		}
+	}
+
+	result := optional
+	if required != nil {
+		//Optional clauses only add to the score of documents that have every required clause
+		result = required
+		for path, score := range optional {
+			if _, ok := result[path]; ok {
+				result[path] += score
+			}
+		}
+	}
+
+	for _, scores := range excluded {
+		for path := range scores {
+			delete(result, path)
+		}
+	}
+	return result
+}
@@ -0,0 +1,380 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/deanrtaylor1/gosearch/lexer"
+)
+
+//Query language of GoSearch
+//
+//  promise chaining         either term (terms side by side are OR'd)
+//  +promise -callback       promise is required, callback is excluded
+//  async AND (await OR then) NOT generator
+//  "event loop"~5           phrase, with an optional proximity in tokens
+
+// Occur is how a clause of a Boolean must occur in a matching document
+type Occur int
+
+const (
+	Should Occur = iota
+	Must
+	MustNot
+)
+
+// Node is an element of the query AST
+type Node interface {
+	node()
+}
+
+// Term matches documents containing a single (stemmed) token
+type Term struct {
+	Value string
+}
+
+// Phrase matches documents containing the terms in order, Slop is the proximity allowed by ~N (0 is exact)
+type Phrase struct {
+	Terms []string
+	Slop  int
+}
+
+// Clause is a child of a Boolean and how it must occur
+type Clause struct {
+	Occur Occur
+	Node  Node
+}
+
+// Boolean combines clauses, documents must match every Must clause (or any Should clause when there are
+// no Must clauses) and no MustNot clause
+type Boolean struct {
+	Clauses []Clause
+}
+
+func (Term) node()    {}
+func (Phrase) node()  {}
+func (Boolean) node() {}
+
+type itemType int
+
+const (
+	itemWord itemType = iota
+	itemPhrase
+	itemPlus
+	itemMinus
+	itemAnd
+	itemOr
+	itemNot
+	itemOpen
+	itemClose
+)
+
+type item struct {
+	typ  itemType
+	text string
+	slop int
+}
+
+// This function splits the raw query into words, phrases and operators
+func scan(input string) ([]item, error) {
+	items := []item{}
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			items = append(items, item{typ: itemOpen})
+			i++
+		case r == ')':
+			items = append(items, item{typ: itemClose})
+			i++
+		case (r == '+' || r == '-') && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			//A prefix only counts as an operator when it is attached to what follows it
+			typ := itemPlus
+			if r == '-' {
+				typ = itemMinus
+			}
+			items = append(items, item{typ: typ})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unclosed quote in query")
+			}
+			phrase := item{typ: itemPhrase, text: string(runes[i+1 : end])}
+			i = end + 1
+
+			if i < len(runes) && runes[i] == '~' {
+				digits := i + 1
+				for digits < len(runes) && unicode.IsDigit(runes[digits]) {
+					digits++
+				}
+				slop, err := strconv.Atoi(string(runes[i+1 : digits]))
+				if err != nil {
+					return nil, fmt.Errorf("invalid proximity after phrase %q", phrase.text)
+				}
+				phrase.slop = slop
+				i = digits
+			}
+			items = append(items, phrase)
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+			word := string(runes[i:end])
+			i = end
+
+			switch word {
+			case "AND", "&&":
+				items = append(items, item{typ: itemAnd})
+			case "OR", "||":
+				items = append(items, item{typ: itemOr})
+			case "NOT":
+				items = append(items, item{typ: itemNot})
+			default:
+				items = append(items, item{typ: itemWord, text: word})
+			}
+		}
+	}
+	return items, nil
+}
+
+// maxDepth is how deeply groups and prefix operators may nest, the parser recurses once per level
+const maxDepth = 100
+
+type parser struct {
+	items []item
+	pos   int
+	depth int
+}
+
+// This function enters a nested group or operator, deeper queries are rejected rather than exhausting the stack
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxDepth {
+		return fmt.Errorf("query is nested more than %d levels deep", maxDepth)
+	}
+	return nil
+}
+
+func (p *parser) peek() (item, bool) {
+	if p.pos >= len(p.items) {
+		return item{}, false
+	}
+	return p.items[p.pos], true
+}
+
+// This function parses a query string into its AST, terms are stemmed with the same lexer used for indexing
+func Parse(input string) (Node, error) {
+	items, err := scan(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{items: items}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next, ok := p.peek(); ok && next.typ == itemClose {
+		return nil, errors.New("unexpected ')' in query")
+	}
+	return node, nil
+}
+
+// orExpr := andExpr { ["OR"] andExpr }
+func (p *parser) parseOr() (Node, error) {
+	clauses := []Clause{}
+	for {
+		next, ok := p.peek()
+		if !ok || next.typ == itemClose {
+			break
+		}
+		if next.typ == itemOr {
+			p.pos++
+			continue
+		}
+
+		clause, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if clause.Node != nil {
+			clauses = append(clauses, clause)
+		}
+	}
+	return simplify(clauses), nil
+}
+
+// andExpr := unary { "AND" unary }
+func (p *parser) parseAnd() (Clause, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return Clause{}, err
+	}
+
+	clauses := []Clause{first}
+	for {
+		next, ok := p.peek()
+		if !ok || next.typ != itemAnd {
+			break
+		}
+		p.pos++
+
+		clause, err := p.parseUnary()
+		if err != nil {
+			return Clause{}, err
+		}
+		clauses = append(clauses, clause)
+	}
+
+	if len(clauses) == 1 {
+		return first, nil
+	}
+
+	and := Boolean{}
+	for _, clause := range clauses {
+		if clause.Node == nil {
+			continue
+		}
+		if clause.Occur == Should {
+			clause.Occur = Must
+		}
+		and.Clauses = append(and.Clauses, clause)
+	}
+	return Clause{Occur: Should, Node: and}, nil
+}
+
+// unary := ("NOT" | "-" | "+") unary | primary
+func (p *parser) parseUnary() (Clause, error) {
+	next, ok := p.peek()
+	if !ok {
+		return Clause{}, errors.New("query ends with an operator")
+	}
+
+	switch next.typ {
+	case itemNot, itemMinus, itemPlus:
+		p.pos++
+		if err := p.enter(); err != nil {
+			return Clause{}, err
+		}
+		clause, err := p.parseUnary()
+		p.depth--
+		if err != nil {
+			return Clause{}, err
+		}
+		if next.typ == itemPlus {
+			clause.Occur = Must
+		} else {
+			clause.Occur = MustNot
+		}
+		return clause, nil
+	}
+
+	node, err := p.parsePrimary()
+	return Clause{Occur: Should, Node: node}, err
+}
+
+// primary := WORD | PHRASE | "(" orExpr ")"
+func (p *parser) parsePrimary() (Node, error) {
+	next, _ := p.peek()
+	p.pos++
+
+	switch next.typ {
+	case itemWord:
+		return wordNode(next.text), nil
+	case itemPhrase:
+		terms := lexer.Tokenize(next.text)
+		switch len(terms) {
+		case 0:
+			return nil, nil
+		case 1:
+			return Term{Value: terms[0]}, nil
+		}
+		return Phrase{Terms: terms, Slop: next.slop}, nil
+	case itemOpen:
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		if closing, ok := p.peek(); !ok || closing.typ != itemClose {
+			return nil, errors.New("missing ')' in query")
+		}
+		p.pos++
+		return node, nil
+	case itemClose:
+		return nil, errors.New("unexpected ')' in query")
+	}
+	return nil, errors.New("operator is missing an operand")
+}
+
+// This function converts a single word into a node, the lexer can split a word like promise.then
+// into several tokens which are kept together as a phrase, punctuation is dropped unless it is all there is
+func wordNode(word string) Node {
+	tokens := lexer.Tokenize(word)
+	terms := []string{}
+	for _, token := range tokens {
+		if strings.IndexFunc(token, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) >= 0 {
+			terms = append(terms, token)
+		}
+	}
+
+	switch {
+	case len(terms) == 1:
+		return Term{Value: terms[0]}
+	case len(terms) > 1:
+		return Phrase{Terms: tokens}
+	case len(tokens) == 1:
+		return Term{Value: tokens[0]}
+	case len(tokens) > 1:
+		return Phrase{Terms: tokens}
+	}
+	return nil
+}
+
+// This function removes needless nesting, a lone optional or required clause is the same as its node
+func simplify(clauses []Clause) Node {
+	if len(clauses) == 0 {
+		return nil
+	}
+	if len(clauses) == 1 && clauses[0].Occur != MustNot {
+		return clauses[0].Node
+	}
+	return Boolean{Clauses: clauses}
+}
+
+// This function returns the terms a matching document may contain, excluded terms are left out
+func Terms(node Node) []string {
+	terms := []string{}
+	var walk func(Node)
+	walk = func(n Node) {
+		switch n := n.(type) {
+		case Term:
+			terms = append(terms, n.Value)
+		case Phrase:
+			terms = append(terms, n.Terms...)
+		case Boolean:
+			for _, clause := range n.Clauses {
+				if clause.Occur != MustNot {
+					walk(clause.Node)
+				}
+			}
+		}
+	}
+	walk(node)
+	return terms
+}
@@ -0,0 +1,206 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected Node
+	}{
+		{
+			name:     "Single term",
+			query:    "Promises",
+			expected: Term{Value: "promis"},
+		},
+		{
+			name:  "Implicit OR",
+			query: "promise chaining",
+			expected: Boolean{Clauses: []Clause{
+				{Occur: Should, Node: Term{Value: "promis"}},
+				{Occur: Should, Node: Term{Value: "chain"}},
+			}},
+		},
+		{
+			name:  "Required and excluded",
+			query: "+promise -callback then",
+			expected: Boolean{Clauses: []Clause{
+				{Occur: Must, Node: Term{Value: "promis"}},
+				{Occur: MustNot, Node: Term{Value: "callback"}},
+				{Occur: Should, Node: Term{Value: "then"}},
+			}},
+		},
+		{
+			name:  "AND binds tighter than OR",
+			query: "async OR await AND then",
+			expected: Boolean{Clauses: []Clause{
+				{Occur: Should, Node: Term{Value: "async"}},
+				{Occur: Should, Node: Boolean{Clauses: []Clause{
+					{Occur: Must, Node: Term{Value: "await"}},
+					{Occur: Must, Node: Term{Value: "then"}},
+				}}},
+			}},
+		},
+		{
+			name:  "Grouping and NOT",
+			query: "(async OR await) AND NOT generator",
+			expected: Boolean{Clauses: []Clause{
+				{Occur: Must, Node: Boolean{Clauses: []Clause{
+					{Occur: Should, Node: Term{Value: "async"}},
+					{Occur: Should, Node: Term{Value: "await"}},
+				}}},
+				{Occur: MustNot, Node: Term{Value: "generat"}},
+			}},
+		},
+		{
+			name:     "Phrase with proximity",
+			query:    `"event loop"~5`,
+			expected: Phrase{Terms: []string{"event", "loop"}, Slop: 5},
+		},
+		{
+			name:     "Single quoted word",
+			query:    `"closure"`,
+			expected: Term{Value: "closur"},
+		},
+		{
+			name:     "Word split by the lexer",
+			query:    "promise.then",
+			expected: Phrase{Terms: []string{"promis", ".", "then"}},
+		},
+		{
+			name:     "Trailing punctuation",
+			query:    "closure?",
+			expected: Term{Value: "closur"},
+		},
+		{
+			name:     "Hyphen inside a word",
+			query:    "async-await",
+			expected: Phrase{Terms: []string{"async", "-", "await"}},
+		},
+		{
+			name:     "Only an exclusion",
+			query:    "-callback",
+			expected: Boolean{Clauses: []Clause{{Occur: MustNot, Node: Term{Value: "callback"}}}},
+		},
+		{
+			name:     "Empty",
+			query:    "  ",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			node, err := Parse(tc.query)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned error %v", tc.query, err)
+			}
+			if !reflect.DeepEqual(node, tc.expected) {
+				t.Errorf("Expected: %#v, got: %#v", tc.expected, node)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		`"event loop`,
+		"(async OR await",
+		"async)",
+		"async AND",
+		"NOT",
+		`"event loop"~x`,
+	}
+
+	for _, q := range invalid {
+		if _, err := Parse(q); err == nil {
+			t.Errorf("Parse(%q) returned no error, want an error", q)
+		}
+	}
+}
+
+func TestParseDepth(t *testing.T) {
+	testCases := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{name: "Nested groups within the limit", query: strings.Repeat("(", 50) + "async" + strings.Repeat(")", 50)},
+		{name: "Deeply nested groups", query: strings.Repeat("(", 5_000_000), wantErr: true},
+		{name: "Long NOT chain", query: strings.Repeat("NOT ", 1_000_000) + "async", wantErr: true},
+		{name: "Long prefix chain", query: strings.Repeat("-", 1_000_000) + "async", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.query)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTerms(t *testing.T) {
+	node, err := Parse(`+promise "event loop" -callback (async OR NOT generator)`)
+	if err != nil {
+		t.Fatalf("Parse() returned error %v", err)
+	}
+
+	expected := []string{"promis", "event", "loop", "async"}
+	if terms := Terms(node); !reflect.DeepEqual(terms, expected) {
+		t.Errorf("Expected: %v, got: %v", expected, terms)
+	}
+}
+
+// fakeScorer returns fixed scores per term and phrase so only the boolean logic is tested
+type fakeScorer map[string]map[string]float32
+
+func (f fakeScorer) ScoreTerm(term string) map[string]float32 {
+	scores := make(map[string]float32)
+	for path, score := range f[term] {
+		scores[path] = score
+	}
+	return scores
+}
+
+func (f fakeScorer) ScorePhrase(phrase Phrase) map[string]float32 {
+	return map[string]float32{}
+}
+
+func TestEvaluate(t *testing.T) {
+	scorer := fakeScorer{
+		"async":   {"/a": 1, "/b": 1, "/c": 1},
+		"await":   {"/a": 2, "/d": 2},
+		"generat": {"/c": 4},
+	}
+
+	testCases := []struct {
+		query    string
+		expected map[string]float32
+	}{
+		{query: "async await", expected: map[string]float32{"/a": 3, "/b": 1, "/c": 1, "/d": 2}},
+		{query: "async AND await", expected: map[string]float32{"/a": 3}},
+		{query: "+async await", expected: map[string]float32{"/a": 3, "/b": 1, "/c": 1}},
+		{query: "async -generator", expected: map[string]float32{"/a": 1, "/b": 1}},
+		{query: "(async OR await) AND NOT generator", expected: map[string]float32{"/a": 3, "/b": 1, "/d": 2}},
+		{query: "-generator", expected: map[string]float32{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			node, err := Parse(tc.query)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned error %v", tc.query, err)
+			}
+			scores := Evaluate(node, scorer)
+			if !reflect.DeepEqual(scores, tc.expected) {
+				t.Errorf("Expected: %v, got: %v", tc.expected, scores)
+			}
+		})
+	}
+}
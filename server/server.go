@@ -1,15 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/deanrtaylor1/gosearch/bm25"
+	"github.com/deanrtaylor1/gosearch/query"
 	"github.com/deanrtaylor1/gosearch/tfidf"
 	"github.com/deanrtaylor1/gosearch/util"
 	webcrawler "github.com/deanrtaylor1/gosearch/web-crawler"
@@ -20,8 +27,18 @@ import (
 type Response struct {
 	Message string            `json:"Message"`
 	Data    []bm25.ResultsMap `json:"Data"`
+	Total   int               `json:"Total"`
+	Offset  int               `json:"Offset"`
+	Limit   int               `json:"Limit"`
 }
 
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchOffset    = 10000
+	maxQueryBytes      = 1 << 16
+)
+
 type IndexResponse struct {
 	Message string
 	Data    []string
@@ -42,15 +59,29 @@ type ProgressResponseData struct {
 	Value interface{} `json:"data_value"`
 }
 
-// Server route to initialize the crawl on a go routine
-func handleApiCrawl(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
+// Options are the settings the server is started with
+type Options struct {
+	//AllowProxy and AllowInsecureTLS let API callers send a crawl through a proxy or skip TLS verification, both
+	//change where the server's requests go or what they trust so they are off unless the server enables them
+	AllowProxy       bool
+	AllowInsecureTLS bool
+}
+
+// Server route to initialize the crawl on a go routine, ?recrawl=true re-crawls the existing index of the host and
+// ?resume=true continues an interrupted crawl of the host from its last checkpoint
+func handleApiCrawl(w http.ResponseWriter, r *http.Request, model *bm25.Model, options Options) {
 	requestBodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	log.Println(string(requestBodyBytes))
-	urlToCrawl := string(requestBodyBytes)
+	urlToCrawl, crawlOptions, err := parseCrawlRequest(requestBodyBytes, options)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid crawl options: %v", err))
+		return
+	}
+	//Only the url is logged as the body may hold credentials
+	log.Println(urlToCrawl)
 	_, err = url.ParseRequestURI(urlToCrawl)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -67,15 +98,51 @@ func handleApiCrawl(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
 		return
 	}
 
+	//recrawl=true updates the existing index of the host, only refetching the pages that changed
+	recrawl := r.URL.Query().Get("recrawl") == "true"
+	if recrawl {
+		parsedUrl, _ := url.Parse(urlToCrawl)
+		if isValid, _ := util.CheckDirIsValid("./indexes/" + parsedUrl.Host); !isValid {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("There is no index of %s to re-crawl", parsedUrl.Host))
+			return
+		}
+	}
+	//resume=true continues the crawl with the settings it was started with, the ones in the request are ignored
+	resume := r.URL.Query().Get("resume") == "true"
+	if resume && !webcrawler.HasCheckpoint(urlToCrawl) {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("There is no interrupted crawl of %s to resume", urlToCrawl))
+		return
+	}
+
+	//Only one crawl runs at a time as a second one would reset the model the first is writing to
+	activeCrawl.mutex.Lock()
+	defer activeCrawl.mutex.Unlock()
+	if activeCrawl.job.Running() {
+		writeJSONMessage(w, http.StatusConflict, fmt.Sprintf("A crawl of %s is running, cancel it first", activeCrawl.job.URL))
+		return
+	}
+
 	bm25.ResetModel(model)
 
-	go func() {
-		webcrawler.CrawlDomainUpdateModel(urlToCrawl, model, bm25.FileOpsImpl{}, 10000)
+	activeCrawl.job = webcrawler.StartCrawlJob(urlToCrawl, func(ctx context.Context) error {
+		var err error
+		if resume {
+			err = webcrawler.ResumeCrawl(ctx, urlToCrawl, model, bm25.FileOpsImpl{}, crawlOptions.HTTP)
+		} else if recrawl {
+			err = webcrawler.RecrawlDomainUpdateModel(ctx, urlToCrawl, model, bm25.FileOpsImpl{}, crawlOptions)
+		} else {
+			err = webcrawler.CrawlDomainUpdateModel(ctx, urlToCrawl, model, bm25.FileOpsImpl{}, crawlOptions)
+		}
+		//A cancelled crawl leaves the pages crawled so far in the model, they can still be searched
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Println(util.TerminalRed, err, util.TerminalReset)
+			return err
+		}
 		model.ModelLock.Lock()
-		model.Name = urlToCrawl
 		model.DA = float32(model.TermCount) / float32(model.DocCount)
 		model.ModelLock.Unlock()
-	}()
+		return err
+	})
 
 	response := &Response{
 		Message: fmt.Sprintf("INTIALIZING CRAWLER THROUGH %v", urlToCrawl),
@@ -93,11 +160,180 @@ func handleApiCrawl(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
 	}
 
 	log.Println("------------------")
-	fmt.Printf("/33]32m INTIALIZING CRAWLER THROUGH %v", string(requestBodyBytes))
+	fmt.Printf("/33]32m INTIALIZING CRAWLER THROUGH %v", urlToCrawl)
 	log.Println("------------------")
 
 }
 
+// activeCrawl is the crawl started through the API
+var activeCrawl struct {
+	mutex sync.Mutex
+	job   *webcrawler.CrawlJob
+}
+
+// Server route to cancel the running crawl, it responds once the pages crawled so far are saved as a partial index
+func handleApiCrawlCancel(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
+	activeCrawl.mutex.Lock()
+	job := activeCrawl.job
+	activeCrawl.mutex.Unlock()
+
+	if !job.Running() {
+		writeJSONMessage(w, http.StatusConflict, "No crawl is running")
+		return
+	}
+	if err := job.Cancel(); err != nil && !errors.Is(err, context.Canceled) {
+		writeJSONMessage(w, http.StatusInternalServerError, fmt.Sprintf("Crawl of %s failed: %v", job.URL, err))
+		return
+	}
+
+	model.ModelLock.Lock()
+	docCount := model.DocCount
+	model.ModelLock.Unlock()
+	writeJSONMessage(w, http.StatusOK, fmt.Sprintf("Crawl of %s cancelled, %d pages saved", job.URL, docCount))
+}
+
+// crawlRequest is the JSON body of /api/crawl, settings that are left out keep their defaults
+type crawlRequest struct {
+	URL               string  `json:"url"`
+	URLLimit          int     `json:"url_limit"`
+	Concurrency       int     `json:"concurrency"`
+	RequestsPerSecond float64 `json:"rps"`
+	//Timeout is a duration such as "10s"
+	Timeout      string   `json:"timeout"`
+	Include      []string `json:"include"`
+	Exclude      []string `json:"exclude"`
+	MaxDepth     int      `json:"max_depth"`
+	AllowedHosts []string `json:"allowed_hosts"`
+	//CheckpointInterval is a duration such as "1m"
+	CheckpointInterval string `json:"checkpoint_interval"`
+	//MaxBodySize is the most bytes of a page that are downloaded
+	MaxBodySize int64 `json:"max_body_size"`
+	MaxRetries  int   `json:"retries"`
+	//RetryBackoff and MaxRetryDelay are durations such as "500ms"
+	RetryBackoff  string `json:"retry_backoff"`
+	MaxRetryDelay string `json:"max_retry_delay"`
+	//The settings of the http client, credentials are only sent to the initial URL's host. CookieFile is only read
+	//to reject it, a path on the server can only be given from the CLI
+	UserAgent          string            `json:"user_agent"`
+	Headers            map[string]string `json:"headers"`
+	CookieFile         string            `json:"cookie_file"`
+	BasicAuthUser      string            `json:"basic_auth_user"`
+	BasicAuthPassword  string            `json:"basic_auth_password"`
+	BearerToken        string            `json:"bearer_token"`
+	Proxy              string            `json:"proxy"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+}
+
+// This function reads the url and settings of a crawl from the request body, which is either a JSON object
+// or, as the web UI sends it, just the url. Client settings the server doesn't allow are rejected
+func parseCrawlRequest(body []byte, serverOptions Options) (string, webcrawler.CrawlOptions, error) {
+	options := webcrawler.DefaultCrawlOptions
+	trimmed := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(trimmed, "{") {
+		return trimmed, options, nil
+	}
+
+	request := crawlRequest{
+		URLLimit:          options.URLLimit,
+		Concurrency:       options.Concurrency,
+		RequestsPerSecond: options.RequestsPerSecond,
+		MaxRetries:        options.MaxRetries,
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", options, err
+	}
+	if request.Concurrency < 1 {
+		return "", options, fmt.Errorf("concurrency must be at least 1")
+	}
+	if request.CookieFile != "" {
+		return "", options, fmt.Errorf("cookie_file can only be set from the CLI, cookies can be sent in a Cookie header which only goes to the initial URL's host")
+	}
+	if request.Proxy != "" && !serverOptions.AllowProxy {
+		return "", options, fmt.Errorf("proxy isn't allowed, start the server with %s=true to allow it", AllowProxyEnv)
+	}
+	if request.InsecureSkipVerify && !serverOptions.AllowInsecureTLS {
+		return "", options, fmt.Errorf("insecure_skip_verify isn't allowed, start the server with %s=true to allow it", AllowInsecureTLSEnv)
+	}
+	options.URLLimit = request.URLLimit
+	options.Concurrency = request.Concurrency
+	options.RequestsPerSecond = request.RequestsPerSecond
+	options.Include = request.Include
+	options.Exclude = request.Exclude
+	options.MaxDepth = request.MaxDepth
+	options.AllowedHosts = request.AllowedHosts
+	if request.MaxBodySize != 0 {
+		options.MaxBodySize = request.MaxBodySize
+	}
+	options.MaxRetries = request.MaxRetries
+	options.HTTP = webcrawler.HTTPOptions{
+		UserAgent:          request.UserAgent,
+		Headers:            request.Headers,
+		BasicAuthUser:      request.BasicAuthUser,
+		BasicAuthPassword:  request.BasicAuthPassword,
+		BearerToken:        request.BearerToken,
+		Proxy:              request.Proxy,
+		InsecureSkipVerify: request.InsecureSkipVerify,
+	}
+	if request.Timeout != "" {
+		timeout, err := time.ParseDuration(request.Timeout)
+		if err != nil || timeout <= 0 {
+			return "", options, fmt.Errorf("invalid timeout %q", request.Timeout)
+		}
+		options.Timeout = timeout
+	}
+	if request.RetryBackoff != "" {
+		backoff, err := time.ParseDuration(request.RetryBackoff)
+		if err != nil || backoff <= 0 {
+			return "", options, fmt.Errorf("invalid retry backoff %q", request.RetryBackoff)
+		}
+		options.RetryBackoff = backoff
+	}
+	if request.MaxRetryDelay != "" {
+		delay, err := time.ParseDuration(request.MaxRetryDelay)
+		if err != nil || delay <= 0 {
+			return "", options, fmt.Errorf("invalid max retry delay %q", request.MaxRetryDelay)
+		}
+		options.MaxRetryDelay = delay
+	}
+	if request.CheckpointInterval != "" {
+		interval, err := time.ParseDuration(request.CheckpointInterval)
+		if err != nil || interval <= 0 {
+			return "", options, fmt.Errorf("invalid checkpoint interval %q", request.CheckpointInterval)
+		}
+		options.CheckpointInterval = interval
+	}
+	return request.URL, options, options.Validate()
+}
+
+// Server route to get what happened to each url of the crawl that wrote the loaded index or is running,
+// ?outcome=http_error,error only lists the urls with those outcomes and ?failed=true lists the urls that failed
+// after being retried
+func handleApiCrawlReport(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
+	outcomes := []string{}
+	for _, outcome := range strings.Split(r.URL.Query().Get("outcome"), ",") {
+		if outcome = strings.TrimSpace(outcome); outcome != "" {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+
+	var report interface{} = webcrawler.Report(model, outcomes...)
+	if r.URL.Query().Get("failed") == "true" {
+		report = webcrawler.FailedURLs(model)
+	}
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		log.Println("Unable to marshal json: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 // Server route to get the status of the crawl and index
 func handleApiProgress(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
 	model.ModelLock.Lock()
@@ -170,58 +406,65 @@ func handleApiSearch(w http.ResponseWriter, r *http.Request, model *bm25.Model)
 
 	defer stemmer.Close()
 
-	requestBodyBytes, err := io.ReadAll(r.Body)
+	requestBodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxQueryBytes))
 	if err != nil {
 		log.Println(err)
+		writeJSONMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Query must be at most %d bytes", maxQueryBytes))
 		return
 	}
 	log.Println(string(requestBodyBytes))
 
-	var count int
-	result, count := bm25.CalculateBm25(model, string(requestBodyBytes))
-
-	var max int
-	if len(result) < 20 {
-		max = len(result)
-	} else {
-		max = 20
-	}
-
-	for i := 0; i < max; i++ {
-		log.Println(result[i].Path, " => ", result[i].TF)
+	q, err := query.Parse(string(requestBodyBytes))
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err))
+		return
 	}
 
+	opts, err := parseSearchOptions(r, model)
 	if err != nil {
-		log.Println(err)
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid search options: %v", err))
 		return
 	}
+	results := bm25.CalculateBm25(model, q, opts)
+
+	for _, result := range results.Results {
+		log.Println(result.Path, " => ", result.TF)
+	}
 
-	if result[0].TF == 0 {
+	if results.Total > 0 && results.MaxScore == 0 {
 		log.Println("Query too generic, ranking with tf-idf")
 
-		result, count = tfidf.CalculateTfidf(model, string(requestBodyBytes))
+		results = tfidf.CalculateTfidf(model, q, opts)
 
-		for i := 0; i < max; i++ {
-			log.Println(result[i].Path, " => ", result[i].TF)
+		for _, result := range results.Results {
+			log.Println(result.Path, " => ", result.TF)
 		}
 
 	}
+	count := results.Count
 
 	var data []bm25.ResultsMap
 
-	if result[0].TF == 0 {
+	if results.MaxScore == 0 {
 		data = []bm25.ResultsMap{{
 			Path: "No results found",
 			TF:   0,
 		}}
 	} else {
-		data = bm25.FilterResults(result[:max], bm25.IsGreaterThanZero)
+		data = bm25.FilterResults(results.Results, bm25.IsGreaterThanZero)
+		if data == nil {
+			data = []bm25.ResultsMap{}
+		}
+		bm25.AddSnippets(model, data, q)
 	}
 
 	elapsed := time.Since(start)
 	response := &Response{
 		Message: fmt.Sprintf("Queried %d documents in %d Ms", count, elapsed.Milliseconds()),
 		Data:    data,
+		Total:   results.Total,
+		Offset:  opts.Offset,
+		Limit:   opts.K,
 	}
 	jsonBytes, err := json.Marshal(response)
 	if err != nil {
@@ -241,6 +484,143 @@ func handleApiSearch(w http.ResponseWriter, r *http.Request, model *bm25.Model)
 
 }
 
+// Reads the limit and offset query parameters used to page through search results and the optional
+// ranking parameters overriding the configuration of the model for this search:
+// variant (bm25, bm25+ or bm25plus, bm25l), k1, b, delta and weights (e.g. weights=title:4,body:1).
+// explain=true adds the per term breakdown of each score to the results
+func parseSearchOptions(r *http.Request, model *bm25.Model) (bm25.SearchOptions, error) {
+	opts := bm25.SearchOptions{K: defaultSearchLimit}
+	params := r.URL.Query()
+
+	if limit, err := strconv.Atoi(params.Get("limit")); err == nil && limit > 0 {
+		opts.K = limit
+	}
+	if opts.K > maxSearchLimit {
+		opts.K = maxSearchLimit
+	}
+	if offset, err := strconv.Atoi(params.Get("offset")); err == nil && offset > 0 {
+		if offset > maxSearchOffset {
+			return opts, fmt.Errorf("offset must be at most %d, got %d", maxSearchOffset, offset)
+		}
+		opts.Offset = offset
+	}
+	if params.Has("explain") {
+		explain, err := strconv.ParseBool(params.Get("explain"))
+		if err != nil {
+			return opts, fmt.Errorf("explain must be true or false, got %q", params.Get("explain"))
+		}
+		opts.Explain = explain
+	}
+
+	if !params.Has("variant") && !params.Has("k1") && !params.Has("b") && !params.Has("delta") && !params.Has("weights") {
+		return opts, nil
+	}
+
+	model.ModelLock.Lock()
+	ranking := model.Ranking
+	model.ModelLock.Unlock()
+
+	if params.Has("variant") {
+		variant, err := bm25.ParseVariant(params.Get("variant"))
+		if err != nil {
+			return opts, err
+		}
+		ranking.Variant = variant
+	}
+	for name, value := range map[string]*float32{"k1": &ranking.K1, "b": &ranking.B, "delta": &ranking.Delta} {
+		if !params.Has(name) {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(params.Get(name), 32)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be a number, got %q", name, params.Get(name))
+		}
+		*value = float32(parsed)
+	}
+	if params.Has("weights") {
+		for _, pair := range strings.Split(params.Get("weights"), ",") {
+			name, value, _ := strings.Cut(pair, ":")
+			field, ok := bm25.ParseField(name)
+			if !ok {
+				return opts, fmt.Errorf("unknown field %q in weights", name)
+			}
+			weight, err := strconv.ParseFloat(value, 32)
+			if err != nil {
+				return opts, fmt.Errorf("the %s weight must be a number, got %q", name, value)
+			}
+			ranking.FieldWeights[field] = float32(weight)
+		}
+	}
+
+	if err := ranking.Validate(); err != nil {
+		return opts, err
+	}
+	opts.Ranking = &ranking
+	return opts, nil
+}
+
+// Server route to read (GET) or update (POST) the ranking configuration of the loaded index,
+// updates are json with any of variant, k1, b, delta and field_weights and are saved with the index
+func handleApiRanking(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
+	model.ModelLock.Lock()
+	ranking := model.Ranking
+	indexName := model.Name
+	model.ModelLock.Unlock()
+
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&ranking); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid ranking configuration: %v", err))
+			return
+		}
+		variant, err := bm25.ParseVariant(string(ranking.Variant))
+		if err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid ranking configuration: %v", err))
+			return
+		}
+		ranking.Variant = variant
+		if err := ranking.Validate(); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid ranking configuration: %v", err))
+			return
+		}
+
+		model.ModelLock.Lock()
+		model.Ranking = ranking
+		model.ModelLock.Unlock()
+
+		if isValid, _ := util.CheckDirIsValid("./indexes/" + indexName); indexName != "" && isValid {
+			if err := bm25.SaveRankingConfig("./indexes/"+indexName, ranking); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	jsonBytes, err := json.Marshal(ranking)
+	if err != nil {
+		log.Println("Unable to marshal json: ", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Utility function to respond with a json message and status code
+func writeJSONMessage(w http.ResponseWriter, status int, message string) {
+	response, err := json.Marshal(struct{ Message string }{Message: message})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(response)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 // Server route to get the available indexes in the users index directory if there are any
 func handleApiIndexes(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
 	directories := util.GetCurrentAvailableModelDirectories()
@@ -293,12 +673,30 @@ func handleApiIndex(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
 	}
 	log.Println("received number 2")
 
+	//Loading an index resets the model, which a running crawl is writing to
+	activeCrawl.mutex.Lock()
+	defer activeCrawl.mutex.Unlock()
+	if activeCrawl.job.Running() {
+		writeJSONMessage(w, http.StatusConflict, fmt.Sprintf("A crawl of %s is running, cancel it first", activeCrawl.job.URL))
+		return
+	}
+
+	//Check the manifest before resetting the model so a corrupt index doesn't replace the loaded one
+	if err := bm25.VerifyIndex("./indexes/" + string(requestBodyBytes)); err != nil {
+		log.Println(util.TerminalRed, err, util.TerminalReset)
+		writeJSONMessage(w, http.StatusUnprocessableEntity, fmt.Sprintf("Index can't be loaded: %v", err))
+		return
+	}
+
 	bm25.ResetModel(model)
 
 	log.Println("Starting server and indexing directory: ", "./indexes/", string(requestBodyBytes))
 	model.Name = string(requestBodyBytes)
 	go func() {
-		bm25.LoadCachedGobToModel("./indexes/"+string(requestBodyBytes), model)
+		if err := bm25.LoadCachedGobToModel("./indexes/"+string(requestBodyBytes), model); err != nil {
+			log.Println(util.TerminalRed, err, util.TerminalReset)
+			return
+		}
 		model.ModelLock.Lock()
 		model.DA = float32(model.TermCount) / float32(model.DocCount)
 		model.IsComplete = true
@@ -319,7 +717,7 @@ func handleApiIndex(w http.ResponseWriter, r *http.Request, model *bm25.Model) {
 }
 
 // Route handler
-func handleRequests(model *bm25.Model) http.HandlerFunc {
+func handleRequests(model *bm25.Model, options Options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.Method, r.URL.Path)
 		switch {
@@ -338,11 +736,17 @@ func handleRequests(model *bm25.Model) http.HandlerFunc {
 		case r.Method == "GET" && r.URL.Path == "/api/progress":
 			handleApiProgress(w, r, model)
 		case r.Method == "POST" && r.URL.Path == "/api/crawl":
-			handleApiCrawl(w, r, model)
+			handleApiCrawl(w, r, model, options)
+		case r.Method == "POST" && r.URL.Path == "/api/crawl/cancel":
+			handleApiCrawlCancel(w, r, model)
+		case r.Method == "GET" && r.URL.Path == "/api/crawl/report":
+			handleApiCrawlReport(w, r, model)
 		case r.Method == "POST" && r.URL.Path == "/api/index":
 			handleApiIndex(w, r, model)
 		case r.Method == "POST" && r.URL.Path == "/api/search":
 			handleApiSearch(w, r, model)
+		case (r.Method == "GET" || r.Method == "POST") && r.URL.Path == "/api/ranking":
+			handleApiRanking(w, r, model)
 		default:
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprint(w, "404 Not Found")
@@ -351,8 +755,23 @@ func handleRequests(model *bm25.Model) http.HandlerFunc {
 	}
 }
 
-func Serve(model *bm25.Model) {
-	http.HandleFunc("/", handleRequests(model))
+// AllowProxyEnv and AllowInsecureTLSEnv are the environment variables that enable Options.AllowProxy and
+// Options.AllowInsecureTLS
+const (
+	AllowProxyEnv       = "GOSEARCH_ALLOW_PROXY"
+	AllowInsecureTLSEnv = "GOSEARCH_ALLOW_INSECURE_TLS"
+)
+
+// This function reads the server options from the environment
+func OptionsFromEnv() Options {
+	return Options{
+		AllowProxy:       os.Getenv(AllowProxyEnv) == "true",
+		AllowInsecureTLS: os.Getenv(AllowInsecureTLSEnv) == "true",
+	}
+}
+
+func Serve(model *bm25.Model, options Options) {
+	http.HandleFunc("/", handleRequests(model, options))
 	log.Println("Listening on port 8080...")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -10,11 +10,24 @@ const indexSelect = document.getElementById("indexSelect");
 const statusBox = document.getElementById("statusBox");
 const indexName = document.getElementById("indexName");
 const resultsTitle = document.getElementById("resultsTitle");
+const pager = document.getElementById("pager");
+const prevPage = document.getElementById("prevPage");
+const nextPage = document.getElementById("nextPage");
+const pageInfo = document.getElementById("pageInfo");
+const pageSize = 20;
+let currentQuery = "";
+let currentOffset = 0;
 
 indexSelect.addEventListener("change", (event) => startIndex(event));
 
 queryForm.addEventListener("submit", (event) =>
-  search(event, queryInput.value)
+  search(event, queryInput.value, 0)
+);
+prevPage.addEventListener("click", (event) =>
+  search(event, currentQuery, Math.max(currentOffset - pageSize, 0))
+);
+nextPage.addEventListener("click", (event) =>
+  search(event, currentQuery, currentOffset + pageSize)
 );
 crawlForm.addEventListener("submit", (event) =>
   startCrawl(event, crawlInput.value)
@@ -41,13 +54,28 @@ function showResults() {
   results.style.display = "flex";
 }
 
-async function search(event, query) {
+function updatePager(apiResult) {
+  if (apiResult.Total <= apiResult.Limit) {
+    pager.classList.add("hidden");
+    return;
+  }
+  pager.classList.remove("hidden");
+  const last = Math.min(apiResult.Offset + apiResult.Limit, apiResult.Total);
+  pageInfo.innerText = `${apiResult.Offset + 1}-${last} of ${apiResult.Total}`;
+  prevPage.disabled = apiResult.Offset === 0;
+  nextPage.disabled = last >= apiResult.Total;
+}
+
+async function search(event, query, offset) {
   event.preventDefault();
   //console.log(query);
   results.innerHTML = "";
   progressBox.innerText = "";
+  currentQuery = query;
+  currentOffset = offset;
 
-  const response = await fetch("/api/search", {
+  const params = new URLSearchParams({ limit: pageSize, offset: offset });
+  const response = await fetch(`/api/search?${params}`, {
     method: "POST",
     headers: {
       "Content-Type": "text/plain",
@@ -77,7 +105,10 @@ async function search(event, query) {
 
     let description = document.createElement("div");
     description.classList.add("result-description");
-    description.innerText = "";
+    // The snippet html is escaped by the server, only the <mark> tags are markup
+    description.innerHTML = (result.snippets || [])
+      .map((snippet) => snippet.html)
+      .join(" ");
 
     newDiv.appendChild(title);
     newDiv.appendChild(url);
@@ -85,6 +116,7 @@ async function search(event, query) {
     results.appendChild(newDiv);
   }
   progressBox.innerText = apiResult.Message;
+  updatePager(apiResult);
 }
 
 const checkProgress = async () => {
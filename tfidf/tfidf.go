@@ -2,10 +2,9 @@ package tfidf
 
 import (
 	"math"
-	"sort"
 
 	"github.com/deanrtaylor1/gosearch/bm25"
-	"github.com/deanrtaylor1/gosearch/lexer"
+	"github.com/deanrtaylor1/gosearch/query"
 )
 
 type TermFreq map[string]int
@@ -26,29 +25,79 @@ type Model struct {
 // this uses tfidf and it is a backup to bm25 as
 // the bm25 gets better results but can return 0 if the term is generic where as tfidf will increase the rank
 // of the document if the term is generic
-func CalculateTfidf(model *bm25.Model, query string) ([]bm25.ResultsMap, int) {
-	var result []bm25.ResultsMap
-	var count int
+// It evaluates the same query AST and postings as bm25 so only documents containing a query term are visited
+func CalculateTfidf(model *bm25.Model, q query.Node, opts bm25.SearchOptions) bm25.SearchResults {
 	model.ModelLock.Lock()
 	defer model.ModelLock.Unlock()
-	for path, table := range model.TFPD {
-		querylexer := lexer.NewLexer(string(query))
-		var rank float32 = 0
-		for {
-			token, err := querylexer.Next()
-			if err != nil {
-				break
-			}
-			rank += ComputeTF(token, table.TermCount, TermFreq(table.Terms)) * ComputeIDF(token, len(model.TFPD), model.DF)
-			count += 1
+
+	scorer := &tfidfScorer{model: model}
+	scores := query.Evaluate(q, scorer)
+
+	results := bm25.TopResults(scores, model.UrlFiles, scorer.count, opts)
+	if opts.Explain {
+		explainTfidf(model, results.Results, q)
+	}
+	return results
+}
+
+// This function explains the tfidf score of each result, the caller must hold the ModelLock
+func explainTfidf(model *bm25.Model, results []bm25.ResultsMap, q query.Node) {
+	terms := bm25.ExplainTerms(q)
+	N := len(model.TFPD)
+
+	for i := range results {
+		doc := model.TFPD[results[i].Path]
+		explanation := &bm25.Explanation{
+			Method:    "tfidf",
+			DocLength: doc.TermCount,
+			DA:        model.DA,
+			DocCount:  N,
+			Terms:     []bm25.TermExplanation{},
+		}
+		for _, term := range terms {
+			freq := model.Postings[term][results[i].Path].Freq
+			tf := computeTF(freq, doc.TermCount)
+			idf := ComputeIDF(term, N, model.DF)
+			explanation.Terms = append(explanation.Terms, bm25.TermExplanation{
+				Term:  term,
+				Freq:  freq,
+				TF:    tf,
+				IDF:   idf,
+				DF:    model.DF[term],
+				Score: tf * idf,
+			})
 		}
-		result = append(result, bm25.ResultsMap{Name: model.UrlFiles[path], Path: path, TF: rank})
-		sort.Slice(result, func(i, j int) bool {
-			return result[i].TF > result[j].TF
-		})
+		results[i].Explanation = explanation
+	}
+}
 
+// tfidfScorer ranks the terms and phrases of a query AST, count is the number of postings scored
+type tfidfScorer struct {
+	model *bm25.Model
+	count int
+}
+
+func (s *tfidfScorer) ScoreTerm(term string) map[string]float32 {
+	scores := make(map[string]float32)
+	idf := ComputeIDF(term, len(s.model.TFPD), s.model.DF)
+	for path, posting := range s.model.Postings[term] {
+		scores[path] = computeTF(posting.Freq, s.model.TFPD[path].TermCount) * idf
+		s.count += 1
 	}
-	return result, count
+	return scores
+}
+
+// Phrases only score the documents where they match, there is no proximity boost in tfidf
+func (s *tfidfScorer) ScorePhrase(phrase query.Phrase) map[string]float32 {
+	scores := make(map[string]float32)
+	for path := range bm25.MatchPhrase(s.model, phrase) {
+		for _, token := range phrase.Terms {
+			idf := ComputeIDF(token, len(s.model.TFPD), s.model.DF)
+			scores[path] += computeTF(s.model.Postings[token][path].Freq, s.model.TFPD[path].TermCount) * idf
+			s.count += 1
+		}
+	}
+	return scores
 }
 
 // This function computes the term frequency of a given term in a document using tfidf
@@ -57,11 +106,20 @@ func ComputeTF(t string, N int, d TermFreq) float32 {
 	//N is the total number of terms (not unique) in the document
 	//d is the map of terms to their frequency in the document
 	if _, ok := d[t]; ok {
-		return float32(d[t]) / float32(N)
+		return computeTF(d[t], N)
 	}
 	return 0
 }
 
+// This function computes the tfidf term frequency from the raw frequency of a term in a document of N terms,
+// a document without terms has a term frequency of 0
+func computeTF(freq int, N int) float32 {
+	if N == 0 {
+		return 0
+	}
+	return float32(freq) / float32(N)
+}
+
 // Compute Inverse document frequency, that is to say, it computes the importance of a term in the collection.
 // By seeing how frequent it is in all other documents vs the current document.
 func ComputeIDF(t string, N int, df DocFreq) float32 {
@@ -8,9 +8,14 @@ import (
 	"os"
 )
 
+// IndexedData is a crawled page, each text field is indexed separately so it can be weighted when ranking,
+// the URL path is indexed as its own field too
 type IndexedData struct {
-	URL     string
-	Content string // Or any other data structure used for storing indexed content
+	URL         string
+	Title       string
+	Headings    string
+	Description string
+	Content     string // The body text of the page
 }
 
 // Utility function, deprecated
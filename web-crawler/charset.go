@@ -0,0 +1,32 @@
+package webcrawler
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// byteOrderMark is left at the start of a page decoded from an encoding with a byte order mark
+const byteOrderMark = "\uFEFF"
+
+// This function transcodes a page to UTF-8 so it is tokenized correctly. The encoding is taken from a byte order mark,
+// the charset of the Content-Type header or a <meta charset> tag, in that order. A page declaring none is read as
+// UTF-8 when it is valid UTF-8 and as windows-1252 otherwise, as browsers do. It returns the name of the encoding
+func decodeBody(body []byte, contentType string) ([]byte, string, error) {
+	encoding, name, certain := charset.DetermineEncoding(body, contentType)
+	//Only the first 1024 bytes are checked for UTF-8, a page whose first non-ASCII character comes later would be
+	//read as windows-1252
+	if !certain && name == "windows-1252" && utf8.Valid(body) {
+		name = "utf-8"
+	}
+	if name == "utf-8" {
+		return bytes.TrimPrefix(body, []byte(byteOrderMark)), name, nil
+	}
+
+	decoded, err := encoding.NewDecoder().Bytes(body)
+	if err != nil {
+		return nil, name, err
+	}
+	return bytes.TrimPrefix(decoded, []byte(byteOrderMark)), name, nil
+}
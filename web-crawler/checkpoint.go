@@ -0,0 +1,169 @@
+package webcrawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/deanrtaylor1/gosearch/bm25"
+)
+
+// CheckpointFileName is the file in an uncommitted generation holding the state of the crawl writing it
+const CheckpointFileName = "checkpoint.gz"
+
+// ErrNoCheckpoint is returned when a crawl is resumed but no interrupted crawl of the domain was checkpointed
+var ErrNoCheckpoint = errors.New("no interrupted crawl to resume")
+
+// checkpointJob is a queued url as it is stored in a checkpoint
+type checkpointJob struct {
+	URL   string
+	Depth int
+}
+
+// crawlCheckpoint is the state of a crawl written alongside the pages indexed so far, the crawl can be resumed from
+// it after the process was stopped
+type crawlCheckpoint struct {
+	Domain  string
+	Options CrawlOptions
+	Recrawl bool
+	//SourceDir is the generation a re-crawl loaded, the content of its unchanged pages is copied from it
+	SourceDir string
+	//Queue are the urls that were found but not crawled yet
+	Queue           []checkpointJob
+	Visited         map[string]bool
+	UrlFiles        map[string]string
+	ReverseUrlFiles map[string]string
+	Previous        map[string]bm25.PageMeta
+	Unchanged       map[string]bool
+	LimitReached    bool
+	Ranking         bm25.RankingConfig
+	Outcomes        map[string]bm25.PageOutcome
+	CreatedAt       time.Time
+}
+
+// resumeState is a checkpoint and the generation it was read from
+type resumeState struct {
+	generation string
+	checkpoint crawlCheckpoint
+}
+
+// This function writes a checkpoint of the crawl to its generation. The documents are flushed and the computed index
+// written before the checkpoint so the files are at least as new as it, it is called when no page is being crawled
+func writeCheckpoint(fileOps bm25.FileOps, generationDir string, model *bm25.Model, documents bm25.DocumentWriter, checkpoint crawlCheckpoint) error {
+	if err := documents.Flush(); err != nil {
+		return err
+	}
+	if _, err := bm25.WriteIndex(model, fileOps, generationDir); err != nil {
+		return err
+	}
+	model.ModelLock.Lock()
+	checkpoint.Ranking = model.Ranking
+	checkpoint.Outcomes = make(map[string]bm25.PageOutcome)
+	for pageUrl, outcome := range model.Outcomes {
+		checkpoint.Outcomes[pageUrl] = outcome
+	}
+	model.ModelLock.Unlock()
+	checkpoint.CreatedAt = time.Now()
+	//Credentials aren't written to the index directory, a resumed crawl is given its client settings again
+	checkpoint.Options.HTTP = HTTPOptions{}
+	return fileOps.CompressAndWriteGzipFile(CheckpointFileName, checkpoint, generationDir)
+}
+
+// This function reads the newest checkpoint of an index directory, only generations that were never committed
+// are searched as a committed one replaced the interrupted crawl
+func readCheckpoint(dirName string) (*resumeState, error) {
+	generations, err := bm25.PendingGenerations(dirName)
+	if os.IsNotExist(err) {
+		return nil, ErrNoCheckpoint
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, generation := range generations {
+		var checkpoint crawlCheckpoint
+		err := bm25.ReadGzipFile(CheckpointFileName, &checkpoint, path.Join(dirName, generation))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &resumeState{generation: generation, checkpoint: checkpoint}, nil
+	}
+	return nil, ErrNoCheckpoint
+}
+
+// This function returns the index directory of a domain
+func indexDirName(domain string) (string, error) {
+	domain, err := NormalizeURL(domain)
+	if err != nil {
+		return "", err
+	}
+	fullUrl, err := url.Parse(domain)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("indexes", fullUrl.Host), nil
+}
+
+// This function reports whether an interrupted crawl of the domain can be resumed
+func HasCheckpoint(domain string) bool {
+	dirName, err := indexDirName(domain)
+	if err != nil {
+		return false
+	}
+	_, err = readCheckpoint(dirName)
+	return err == nil
+}
+
+// This function continues an interrupted crawl of the domain from its last checkpoint: the pages indexed so far are
+// loaded and the urls that were queued are crawled with the settings the crawl was started with. The client settings
+// aren't saved in checkpoints as they may hold credentials, the given ones are used. ErrNoCheckpoint is returned when
+// there is nothing to resume
+func ResumeCrawl(ctx context.Context, domain string, model *bm25.Model, fileOps bm25.FileOps, httpOptions HTTPOptions) error {
+	dirName, err := indexDirName(domain)
+	if err != nil {
+		return err
+	}
+	resume, err := readCheckpoint(dirName)
+	if err != nil {
+		return err
+	}
+	checkpoint := resume.checkpoint
+
+	bm25.ResetModel(model)
+	if err := bm25.LoadCheckpointIndex(path.Join(dirName, resume.generation), model); err != nil {
+		return fmt.Errorf("error loading checkpoint of %s: %v", domain, err)
+	}
+	//Unchanged pages of a re-crawl that weren't written to the new generation yet are copied from the loaded one
+	var store *bm25.SegmentStore
+	if checkpoint.Recrawl && checkpoint.SourceDir != "" {
+		if store, err = bm25.OpenSegmentStore(checkpoint.SourceDir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error loading checkpoint of %s: %v", domain, err)
+		}
+	}
+
+	model.ModelLock.Lock()
+	if store != nil {
+		model.DocStore = store
+	}
+	model.Ranking = checkpoint.Ranking
+	for pageUrl, outcome := range checkpoint.Outcomes {
+		model.Outcomes[pageUrl] = outcome
+	}
+	for pageUrl, fileName := range checkpoint.UrlFiles {
+		model.UrlFiles[pageUrl] = fileName
+	}
+	for fileName, pageUrl := range checkpoint.ReverseUrlFiles {
+		model.ReverseUrlFiles[fileName] = pageUrl
+	}
+	model.ModelLock.Unlock()
+
+	options := checkpoint.Options
+	options.HTTP = httpOptions
+	return crawlDomain(ctx, checkpoint.Domain, model, fileOps, options, checkpoint.Recrawl, resume)
+}
@@ -0,0 +1,201 @@
+package webcrawler
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// HTTPOptions are the settings of the http client a crawl sends its requests with, they let the crawler reach sites
+// behind a login, a proxy or a self-signed certificate
+type HTTPOptions struct {
+	//UserAgent identifies the crawler, robots.txt groups are matched against its product token. DefaultUserAgent is
+	//used when it is empty
+	UserAgent string
+	//Headers are sent with every request to the initial URL's host, they replace the crawler's own headers of the
+	//same name. Like the credentials they aren't sent to other hosts as they may hold cookies or tokens
+	Headers map[string]string
+	//CookieFile is a cookies.txt file in the Netscape format browsers and curl export, its cookies seed the cookie jar
+	CookieFile string
+	//BasicAuthUser and BasicAuthPassword, or BearerToken, authenticate the requests to the initial URL's host.
+	//They aren't sent to other hosts
+	BasicAuthUser     string
+	BasicAuthPassword string
+	BearerToken       string
+	//Proxy is the url of the proxy requests are sent through, the HTTP_PROXY and HTTPS_PROXY environment variables
+	//are used when it is empty
+	Proxy string
+	//InsecureSkipVerify accepts any TLS certificate, for internal hosts with self-signed certificates
+	InsecureSkipVerify bool
+}
+
+// This function returns the user agent requests are sent with
+func (o HTTPOptions) userAgent() string {
+	if o.UserAgent == "" {
+		return DefaultUserAgent
+	}
+	return o.UserAgent
+}
+
+// This function checks the client settings can be used, the proxy must be a url and the cookie file must parse
+func (o HTTPOptions) Validate() error {
+	if o.BearerToken != "" && (o.BasicAuthUser != "" || o.BasicAuthPassword != "") {
+		return fmt.Errorf("basic auth and a bearer token can't both be set")
+	}
+	if o.Proxy != "" {
+		if _, err := parseProxy(o.Proxy); err != nil {
+			return err
+		}
+	}
+	if o.CookieFile != "" {
+		if _, err := readCookieFile(o.CookieFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function parses the url of a proxy
+func parseProxy(proxy string) (*url.URL, error) {
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil || proxyUrl.Scheme == "" || proxyUrl.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q, it must be a url such as http://proxy:8080", proxy)
+	}
+	return proxyUrl, nil
+}
+
+// This function returns the http client of a crawl of host with the timeout and client settings of the options
+func newHTTPClient(options CrawlOptions, host string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.HTTP.Proxy != "" {
+		proxyUrl, err := parseProxy(options.HTTP.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if options.HTTP.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	if options.HTTP.CookieFile != "" {
+		cookies, err := readCookieFile(options.HTTP.CookieFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, cookie := range cookies {
+			jar.SetCookies(cookie.url, []*http.Cookie{cookie.cookie})
+		}
+	}
+
+	return &http.Client{
+		Timeout:   options.Timeout,
+		Jar:       jar,
+		Transport: &headerTransport{base: transport, options: options.HTTP, authHost: host},
+	}, nil
+}
+
+// headerTransport adds the configured headers and credentials to each request to the initial URL's host
+type headerTransport struct {
+	base    http.RoundTripper
+	options HTTPOptions
+	//authHost is the only host headers and credentials are sent to
+	authHost string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	//The transport sees every hop of a redirect, so checking the host here keeps the headers from following a
+	//redirect to another host
+	if !strings.EqualFold(req.URL.Host, t.authHost) {
+		return t.base.RoundTrip(req)
+	}
+	//A RoundTripper mustn't modify the request it is given
+	req = req.Clone(req.Context())
+	for name, value := range t.options.Headers {
+		req.Header.Set(name, value)
+	}
+	switch {
+	case t.options.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+t.options.BearerToken)
+	case t.options.BasicAuthUser != "" || t.options.BasicAuthPassword != "":
+		req.SetBasicAuth(t.options.BasicAuthUser, t.options.BasicAuthPassword)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// fileCookie is a cookie of a cookie file and the url it is set for
+type fileCookie struct {
+	url    *url.URL
+	cookie *http.Cookie
+}
+
+// This function reads a cookies.txt file in the Netscape format: one cookie per line with the tab separated fields
+// domain, include subdomains, path, secure, expiry, name and value. Lines starting with # are comments except
+// #HttpOnly_ which marks an http only cookie
+func readCookieFile(fileName string) ([]fileCookie, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening cookie file: %w", err)
+	}
+	defer file.Close()
+
+	cookies := []fileCookie{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s line %d: a cookie has 7 tab separated fields, found %d", fileName, lineNumber, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid expiry %q", fileName, lineNumber, fields[4])
+		}
+
+		host := strings.TrimPrefix(fields[0], ".")
+		secure := strings.EqualFold(fields[3], "TRUE")
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		//Without a domain the cookie is only sent to the host itself
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+		//An expiry of 0 is a session cookie
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, fileCookie{url: &url.URL{Scheme: scheme, Host: host, Path: fields[2]}, cookie: cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading cookie file: %w", err)
+	}
+	return cookies, nil
+}
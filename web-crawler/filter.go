@@ -0,0 +1,121 @@
+package webcrawler
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks an include or exclude pattern as a regular expression rather than a glob
+const regexPrefix = "re:"
+
+// urlFilter decides which of the links found while crawling are followed
+type urlFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	//hosts are the hosts links may lead to, *.example.com allows every subdomain of example.com
+	hosts []string
+}
+
+// This function compiles the include and exclude patterns and allowed hosts of the crawl options, the host of the
+// initial URL is always allowed
+func newURLFilter(seedHost string, options CrawlOptions) (*urlFilter, error) {
+	filter := &urlFilter{hosts: []string{strings.ToLower(seedHost)}}
+	for _, host := range options.AllowedHosts {
+		filter.hosts = append(filter.hosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+	for _, pattern := range options.Include {
+		compiled, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, compiled)
+	}
+	for _, pattern := range options.Exclude {
+		compiled, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, compiled)
+	}
+	return filter, nil
+}
+
+// This function compiles a url pattern matched against the path and query of a url. Patterns starting with re: are
+// regular expressions, others are globs where * matches within a path segment and ** across segments
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		compiled, err := regexp.Compile(strings.TrimPrefix(pattern, regexPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		return compiled, nil
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("invalid pattern %q: globs match the url path and must start with /", pattern)
+	}
+
+	var expression strings.Builder
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		//A trailing /** also matches the directory itself as normalized urls have no trailing slash
+		case pattern[i:] == "/**":
+			expression.WriteString("(/.*)?")
+			i += len("/**") - 1
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			expression.WriteString("[^/]*")
+		case pattern[i] == '?':
+			expression.WriteString("[^/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expression.WriteString("$")
+	return regexp.MustCompile(expression.String()), nil
+}
+
+// This function reports whether links may lead to a host
+func (f *urlFilter) allowedHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range f.hosts {
+		if host == allowed {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// This function reports whether a link is followed: its host is allowed, it matches an include pattern if there are
+// any and it matches no exclude pattern
+func (f *urlFilter) allowed(parsedURL *url.URL) bool {
+	if !f.allowedHost(parsedURL.Host) {
+		return false
+	}
+
+	target := parsedURL.EscapedPath()
+	if parsedURL.RawQuery != "" {
+		target += "?" + parsedURL.RawQuery
+	}
+	for _, pattern := range f.exclude {
+		if pattern.MatchString(target) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if pattern.MatchString(target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package webcrawler
+
+import (
+	"context"
+)
+
+// CrawlJob is a crawl running in the background that can be cancelled, the server and CLI run one at a time as
+// crawls write to the shared model
+type CrawlJob struct {
+	URL    string
+	cancel context.CancelFunc
+	done   chan struct{}
+	//err is set before done is closed
+	err error
+}
+
+// This function runs crawl in a new goroutine with a context that is cancelled by Cancel
+func StartCrawlJob(url string, crawl func(ctx context.Context) error) *CrawlJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &CrawlJob{URL: url, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		job.err = crawl(ctx)
+		cancel()
+		close(job.done)
+	}()
+	return job
+}
+
+// This function reports whether the crawl is still running, a nil job isn't
+func (j *CrawlJob) Running() bool {
+	if j == nil {
+		return false
+	}
+	select {
+	case <-j.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// This function cancels the crawl and waits until the pages crawled so far are saved
+func (j *CrawlJob) Cancel() error {
+	j.cancel()
+	return j.Wait()
+}
+
+// This function waits for the crawl to finish and returns its error, context.Canceled if it was cancelled
+func (j *CrawlJob) Wait() error {
+	<-j.done
+	return j.err
+}
@@ -0,0 +1,80 @@
+package webcrawler
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// defaultPorts are left out of normalized urls as they are implied by the scheme
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// trackingParams are query parameters added by analytics and ad platforms that don't change the page
+var trackingParams = map[string]bool{
+	"gclid": true, "dclid": true, "fbclid": true, "msclkid": true, "yclid": true, "igshid": true,
+	"mc_cid": true, "mc_eid": true, "_ga": true, "_gl": true,
+}
+
+// This function returns the canonical form of a url so links to the same page compare equal: the scheme and host
+// are lowercased, default ports, fragments, trailing slashes and tracking parameters are removed, dot segments are
+// resolved and the query parameters are sorted. Paths stay case sensitive as servers may treat them so
+func NormalizeURL(rawURL string) (string, error) {
+	parsedURL, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+	if !parsedURL.IsAbs() || parsedURL.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute url", rawURL)
+	}
+
+	parsedURL.Scheme = strings.ToLower(parsedURL.Scheme)
+	host := strings.ToLower(parsedURL.Hostname())
+	if port := parsedURL.Port(); port != "" && port != defaultPorts[parsedURL.Scheme] {
+		host += ":" + port
+	}
+	parsedURL.Host = host
+	parsedURL.Fragment = ""
+	parsedURL.RawFragment = ""
+	parsedURL.User = nil
+
+	//Resolve dot segments and drop the trailing slash, the root path is kept as /
+	urlPath := parsedURL.Path
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	urlPath = path.Clean(urlPath)
+	parsedURL.Path = urlPath
+	//Re-encode the path consistently so %7E and ~ compare equal
+	parsedURL.RawPath = ""
+
+	query := parsedURL.Query()
+	for key := range query {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") || trackingParams[strings.ToLower(key)] {
+			query.Del(key)
+		}
+	}
+	//Encode sorts the parameters by key
+	parsedURL.RawQuery = query.Encode()
+	parsedURL.ForceQuery = false
+
+	return parsedURL.String(), nil
+}
+
+// This function returns the normalized url a page should be indexed under when it isn't the url it was requested
+// with: the <link rel="canonical"> of the page or the url a redirect ended at. Canonical urls on other hosts are ignored
+func canonicalUrl(urlToCrawl string, finalUrl *url.URL, canonical string) string {
+	target := finalUrl.String()
+	if canonical != "" {
+		parsedCanonical, err := url.Parse(canonical)
+		if err == nil {
+			target = finalUrl.ResolveReference(parsedCanonical).String()
+		}
+	}
+
+	normalized, err := NormalizeURL(target)
+	if err != nil || normalized == urlToCrawl || extractDomain(normalized) != extractDomain(urlToCrawl) {
+		return ""
+	}
+	return normalized
+}
@@ -0,0 +1,91 @@
+package webcrawler
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out the requests of a crawl by a fixed interval, a nil limiter doesn't wait
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	mutex    sync.Mutex
+}
+
+// This function returns a limiter allowing one request per interval, or nil if the interval is zero
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	if interval <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: interval}
+}
+
+// This function blocks until the next request may be sent, each caller is given the next free slot.
+// It returns early with the context's error if the crawl is cancelled
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hostLimiters keeps a rate limiter for every host a crawl sends requests to
+type hostLimiters struct {
+	//interval is the spacing requestsPerSecond asks for, a host's crawl delay replaces it when it is longer
+	interval    time.Duration
+	crawlDelays map[string]time.Duration
+	limiters    map[string]*rateLimiter
+	mutex       sync.Mutex
+}
+
+// This function returns limiters allowing requestsPerSecond requests to each host, 0 doesn't limit them
+func newHostLimiters(requestsPerSecond float64) *hostLimiters {
+	var interval time.Duration
+	if requestsPerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return &hostLimiters{interval: interval, crawlDelays: make(map[string]time.Duration), limiters: make(map[string]*rateLimiter)}
+}
+
+// This function spaces the requests to a host by at least the crawl delay of its robots.txt
+func (h *hostLimiters) SetCrawlDelay(host string, crawlDelay time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.crawlDelays[host] = crawlDelay
+	//Requests already waiting keep their slots, the delay applies from the next one
+	delete(h.limiters, host)
+}
+
+// This function blocks until the next request to host may be sent or the crawl is cancelled
+func (h *hostLimiters) Wait(ctx context.Context, host string) error {
+	h.mutex.Lock()
+	limiter, ok := h.limiters[host]
+	if !ok {
+		interval := h.interval
+		if h.crawlDelays[host] > interval {
+			interval = h.crawlDelays[host]
+		}
+		limiter = newRateLimiter(interval)
+		h.limiters[host] = limiter
+	}
+	h.mutex.Unlock()
+
+	return limiter.Wait(ctx)
+}
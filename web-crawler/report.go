@@ -0,0 +1,104 @@
+package webcrawler
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/deanrtaylor1/gosearch/bm25"
+)
+
+// The outcomes recorded for each url the crawler tries to index
+const (
+	OutcomeIndexed = "indexed"
+	//OutcomeNotModified and OutcomeUnchanged are pages of a re-crawl that kept their stored content
+	OutcomeNotModified = "not_modified"
+	OutcomeUnchanged   = "unchanged"
+	//OutcomeRemoved is a page of a re-crawl that is gone and was removed from the index
+	OutcomeRemoved = "removed"
+	//OutcomeHTTPError is a response with a status other than 2xx
+	OutcomeHTTPError = "http_error"
+	//OutcomeUnsupportedType is a response that isn't html or text
+	OutcomeUnsupportedType = "unsupported_type"
+	//OutcomeTooLarge is a response whose body is larger than CrawlOptions.MaxBodySize
+	OutcomeTooLarge = "too_large"
+	//OutcomeError is a request that failed without a response
+	OutcomeError = "error"
+	//OutcomeLoginRedirect is a page that redirected to a login screen, neither it nor the login page is indexed
+	OutcomeLoginRedirect = "login_redirect"
+	OutcomeNoIndex       = "noindex"
+	OutcomeDuplicate     = "duplicate"
+	OutcomeDisallowed    = "disallowed"
+)
+
+// indexedMediaTypes are the content types that are indexed, the lexer reads plain text as an html body
+var indexedMediaTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"text/plain":            true,
+}
+
+// This function returns the media type of a response from its Content-Type header, sniffing it from the start
+// of the body when the header is missing or too generic. body may be nil when only the header is checked
+func mediaType(header http.Header, body []byte) string {
+	declared, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && declared != "application/octet-stream" {
+		return declared
+	}
+	if body == nil {
+		return ""
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	return sniffed
+}
+
+// This function records what happened to a url so the crawl can be reported on
+func (c *crawler) recordOutcome(pageUrl string, outcome bm25.PageOutcome) {
+	c.model.ModelLock.Lock()
+	c.model.Outcomes[pageUrl] = outcome
+	c.model.ModelLock.Unlock()
+}
+
+// CrawlReport summarises the outcomes of a crawl
+type CrawlReport struct {
+	//Counts is the number of urls with each outcome
+	Counts   map[string]int              `json:"counts"`
+	Outcomes map[string]bm25.PageOutcome `json:"outcomes"`
+}
+
+// This function returns the report of the crawl that wrote the model, only the urls with one of the given outcomes
+// are listed when there are any
+func Report(model *bm25.Model, outcomes ...string) CrawlReport {
+	wanted := make(map[string]bool)
+	for _, outcome := range outcomes {
+		wanted[outcome] = true
+	}
+
+	report := CrawlReport{Counts: make(map[string]int), Outcomes: make(map[string]bm25.PageOutcome)}
+	model.ModelLock.Lock()
+	defer model.ModelLock.Unlock()
+	for pageUrl, outcome := range model.Outcomes {
+		report.Counts[outcome.Outcome]++
+		if len(wanted) == 0 || wanted[outcome.Outcome] {
+			report.Outcomes[pageUrl] = outcome
+		}
+	}
+	return report
+}
+
+// loginPathPattern matches the path of the login screens sites redirect to when a page needs credentials
+var loginPathPattern = regexp.MustCompile(`(?i)(^|/)(login|log-in|log_in|logon|signin|sign-in|sign_in|auth|sso|wp-login\.php)(/|\.|$)`)
+
+// passwordInputPattern matches the password field of a login form served at a path that doesn't look like one
+var passwordInputPattern = regexp.MustCompile(`(?i)<input[^>]+type\s*=\s*["']?password`)
+
+// This function reports whether a page redirected to a login screen: the page the redirect ended at has a login
+// path or a password field. Redirects to the same page, such as http to https, aren't login redirects
+func isLoginRedirect(urlToCrawl string, finalUrl *url.URL, body []byte) bool {
+	final, err := NormalizeURL(finalUrl.String())
+	if err != nil || final == urlToCrawl {
+		return false
+	}
+	return loginPathPattern.MatchString(finalUrl.Path) || passwordInputPattern.Match(body)
+}
@@ -0,0 +1,149 @@
+package webcrawler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/deanrtaylor1/gosearch/bm25"
+	"github.com/deanrtaylor1/gosearch/logger"
+)
+
+// retryStatuses are the responses that are retried as the server may be able to answer later
+var retryStatuses = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusServiceUnavailable: true,
+}
+
+// This function reports whether a request error is likely to be transient: a timeout, a reset or refused connection
+// or a connection closed before the response
+func retryableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// This function returns how long to wait before retrying a request: the response's Retry-After when it has one,
+// otherwise an exponential backoff from RetryBackoff with jitter so workers don't retry in step. The wait never
+// exceeds MaxRetryDelay
+func (c *crawler) retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			if delay > c.options.MaxRetryDelay {
+				return c.options.MaxRetryDelay
+			}
+			return delay
+		}
+	}
+
+	//Double the backoff for each attempt, stopping at MaxRetryDelay before doubling could overflow
+	delay := c.options.RetryBackoff
+	for i := 0; i < attempt && delay < c.options.MaxRetryDelay; i++ {
+		if delay > c.options.MaxRetryDelay/2 {
+			delay = c.options.MaxRetryDelay
+		} else {
+			delay *= 2
+		}
+	}
+	if delay > c.options.MaxRetryDelay {
+		delay = c.options.MaxRetryDelay
+	}
+	//Wait between half and all of the backoff
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// This function parses a Retry-After header, either a number of seconds or an http date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// This function sends a request, retrying timeouts, dropped connections and 429 and 503 responses up to MaxRetries
+// times. read is called with each response that isn't retried to read its body, a read that times out or loses its
+// connection is retried like the request. Every attempt waits for the host's rate limit. It returns the last response
+// or error and the number of attempts
+func (c *crawler) fetch(req *http.Request, read func(resp *http.Response) error) (*http.Response, int, error) {
+	for attempt := 0; ; attempt++ {
+		//Wait for the rate limit and crawl delay of the host
+		if err := c.limiters.Wait(c.ctx, req.URL.Host); err != nil {
+			return nil, attempt, err
+		}
+		logger.HandleLog(fmt.Sprintf("Initiating get request to %s", req.URL))
+		resp, err := c.client.Do(req.Clone(c.ctx))
+
+		retry := attempt < c.options.MaxRetries && c.ctx.Err() == nil
+		if err == nil && !(retry && retryStatuses[resp.StatusCode]) {
+			if readErr := read(resp); readErr != nil {
+				resp.Body.Close()
+				resp, err = nil, fmt.Errorf("error reading response body: %w", readErr)
+			}
+		}
+		switch {
+		case err != nil && !(retry && retryableError(err)):
+			return nil, attempt + 1, err
+		case err == nil && !(retry && retryStatuses[resp.StatusCode]):
+			return resp, attempt + 1, nil
+		}
+
+		delay := c.retryDelay(attempt, resp)
+		if err != nil {
+			logger.HandleLog(fmt.Sprintf("%s => %v, retrying in %v", req.URL, err, delay))
+		} else {
+			logger.HandleLog(fmt.Sprintf("%s => status %d, retrying in %v", req.URL, resp.StatusCode, delay))
+			//Read the rest of the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-c.ctx.Done():
+			return nil, attempt + 1, c.ctx.Err()
+		}
+	}
+}
+
+// FailedURL is a url that couldn't be crawled and the outcome of its last attempt
+type FailedURL struct {
+	URL string `json:"url"`
+	bm25.PageOutcome
+}
+
+// This function returns the urls of the crawl that wrote the model that failed with an error or a server error
+// response, after any retries, in order
+func FailedURLs(model *bm25.Model) []FailedURL {
+	failed := []FailedURL{}
+	model.ModelLock.Lock()
+	for pageUrl, outcome := range model.Outcomes {
+		if outcome.Outcome == OutcomeError || (outcome.Outcome == OutcomeHTTPError && (outcome.Status >= 500 || retryStatuses[outcome.Status])) {
+			failed = append(failed, FailedURL{URL: pageUrl, PageOutcome: outcome})
+		}
+	}
+	model.ModelLock.Unlock()
+	sort.Slice(failed, func(i, j int) bool { return failed[i].URL < failed[j].URL })
+	return failed
+}
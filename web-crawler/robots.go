@@ -0,0 +1,256 @@
+package webcrawler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deanrtaylor1/gosearch/lexer"
+	"github.com/deanrtaylor1/gosearch/logger"
+)
+
+const (
+	//DefaultUserAgent identifies the crawler to the sites it crawls, robots.txt groups are matched against its product token
+	DefaultUserAgent = "GoSearch/0.2 (+https://github.com/DeanRTaylor1/gosearch)"
+	//maxRobotsSize is the most of a robots.txt file that is parsed, the rest is ignored as RFC 9309 allows
+	maxRobotsSize = 500 << 10
+	//maxCrawlDelay caps the Crawl-delay a site can ask for so a crawl can't be stalled indefinitely
+	maxCrawlDelay = 30 * time.Second
+)
+
+// robotsRule is a single Allow or Disallow line of a robots.txt group
+type robotsRule struct {
+	pattern string
+	allow   bool
+	regexp  *regexp.Regexp
+}
+
+// robotsGroup is the rules and crawl delay that apply to a set of user agents
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// Robots is a parsed robots.txt file
+type Robots struct {
+	groups []*robotsGroup
+	//Sitemaps are the sitemap urls listed in the file, they apply to every user agent
+	Sitemaps []string
+	//disallowAll is set when robots.txt couldn't be fetched because of a server error, nothing may be crawled
+	disallowAll bool
+}
+
+// This function parses the content of a robots.txt file. Consecutive User-agent lines start a group sharing the rules
+// that follow them, unknown lines and comments are ignored
+func ParseRobots(content string) *Robots {
+	robots := &Robots{}
+	var group *robotsGroup
+	//A User-agent line after a rule starts a new group rather than adding to the current one
+	inRules := false
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if group == nil || inRules {
+				group = &robotsGroup{}
+				robots.groups = append(robots.groups, group)
+				inRules = false
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if group == nil {
+				continue
+			}
+			inRules = true
+			//An empty Disallow allows everything, it adds no rule
+			if value == "" {
+				continue
+			}
+			group.rules = append(group.rules, robotsRule{pattern: value, allow: key == "allow", regexp: compileRobotsPattern(value)})
+		case "crawl-delay":
+			if group == nil {
+				continue
+			}
+			inRules = true
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				group.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		case "sitemap":
+			if value != "" {
+				robots.Sitemaps = append(robots.Sitemaps, value)
+			}
+		}
+	}
+	return robots
+}
+
+// This function converts a robots.txt path pattern to a regular expression, * matches any characters and
+// a trailing $ anchors the pattern to the end of the path
+func compileRobotsPattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	expression := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	if anchored {
+		expression += "$"
+	}
+	return regexp.MustCompile(expression)
+}
+
+// This function returns the product token of a user agent, e.g. gosearch for GoSearch/0.2, which is what groups are matched against
+func productToken(userAgent string) string {
+	token, _, _ := strings.Cut(userAgent, "/")
+	if fields := strings.Fields(token); len(fields) > 0 {
+		token = fields[0]
+	}
+	return strings.ToLower(token)
+}
+
+// This function returns the rules that apply to a user agent: the groups naming it, or the * groups if none do.
+// When no group applies there are no rules and everything is allowed
+func (r *Robots) rulesFor(userAgent string) (rules []robotsRule, crawlDelay time.Duration) {
+	token := productToken(userAgent)
+	matched := false
+	for _, wildcard := range []bool{false, true} {
+		for _, group := range r.groups {
+			for _, agent := range group.agents {
+				if (!wildcard && agent == token) || (wildcard && agent == "*") {
+					matched = true
+					rules = append(rules, group.rules...)
+					if group.crawlDelay > crawlDelay {
+						crawlDelay = group.crawlDelay
+					}
+					break
+				}
+			}
+		}
+		//Groups for the crawler by name replace the * groups
+		if matched {
+			break
+		}
+	}
+	return rules, crawlDelay
+}
+
+// This function reports whether a user agent may crawl a url. The longest matching rule wins and Allow wins a tie,
+// robots.txt itself is always allowed
+func (r *Robots) Allowed(userAgent string, rawURL string) bool {
+	if r == nil {
+		return true
+	}
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	urlPath := parsedURL.EscapedPath()
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	if urlPath == "/robots.txt" {
+		return true
+	}
+	if r.disallowAll {
+		return false
+	}
+	if parsedURL.RawQuery != "" {
+		urlPath += "?" + parsedURL.RawQuery
+	}
+
+	rules, _ := r.rulesFor(userAgent)
+	allowed := true
+	longest := -1
+	for _, rule := range rules {
+		if !rule.regexp.MatchString(urlPath) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			longest = len(rule.pattern)
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+// This function returns the delay a user agent should leave between requests, capped at maxCrawlDelay
+func (r *Robots) CrawlDelay(userAgent string) time.Duration {
+	if r == nil {
+		return 0
+	}
+	_, crawlDelay := r.rulesFor(userAgent)
+	if crawlDelay > maxCrawlDelay {
+		return maxCrawlDelay
+	}
+	return crawlDelay
+}
+
+// This function fetches and parses the robots.txt of a site following RFC 9309: a missing file (4xx) allows everything
+// and a server error or an unreachable site disallows everything
+func fetchRobots(ctx context.Context, client *http.Client, siteUrl *url.URL, userAgent string) *Robots {
+	robotsUrl := &url.URL{Scheme: siteUrl.Scheme, Host: siteUrl.Host, Path: "/robots.txt"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsUrl.String(), nil)
+	if err != nil {
+		logger.HandleError(fmt.Errorf("error creating robots.txt request: %w", err))
+		return &Robots{disallowAll: true}
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.HandleError(fmt.Errorf("error fetching robots.txt, not crawling %s: %w", siteUrl.Host, err))
+		return &Robots{disallowAll: true}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		logger.HandleError(fmt.Errorf("robots.txt returned %d, not crawling %s", resp.StatusCode, siteUrl.Host))
+		return &Robots{disallowAll: true}
+	case resp.StatusCode >= 400:
+		return &Robots{}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRobotsSize))
+	if err != nil {
+		logger.HandleError(fmt.Errorf("error reading robots.txt, not crawling %s: %w", siteUrl.Host, err))
+		return &Robots{disallowAll: true}
+	}
+	return ParseRobots(string(body))
+}
+
+// This function reads the noindex and nofollow directives of the X-Robots-Tag headers of a response, directives
+// prefixed with a user agent (e.g. "otherbot: noindex") only apply when the agent is this crawler
+func headerRobotsDirectives(header http.Header, userAgent string) (noIndex bool, noFollow bool) {
+	token := productToken(userAgent)
+	for _, value := range header.Values("X-Robots-Tag") {
+		if agent, directives, found := strings.Cut(value, ":"); found && !strings.Contains(agent, ",") {
+			agent = strings.ToLower(strings.TrimSpace(agent))
+			if agent != token {
+				continue
+			}
+			value = directives
+		}
+		index, follow := lexer.ParseRobotsDirectives(value)
+		noIndex = noIndex || index
+		noFollow = noFollow || follow
+	}
+	return noIndex, noFollow
+}
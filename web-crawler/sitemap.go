@@ -0,0 +1,190 @@
+package webcrawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deanrtaylor1/gosearch/logger"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	//maxSitemapSize is the largest uncompressed sitemap the protocol allows
+	maxSitemapSize = 50 << 20
+	//maxSitemaps caps the number of sitemaps read through sitemap index files
+	maxSitemaps = 100
+)
+
+// SitemapURL is a page listed in a sitemap, LastMod is zero when the sitemap doesn't give it
+type SitemapURL struct {
+	Loc     string
+	LastMod time.Time
+}
+
+// sitemapEntry is a <url> of a urlset or a <sitemap> of a sitemap index
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// sitemapDocument decodes both a urlset and a sitemap index, only one of the lists is filled
+type sitemapDocument struct {
+	URLs     []sitemapEntry `xml:"url"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+}
+
+// lastModLayouts are the W3C datetime formats a lastmod may be written in
+var lastModLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"}
+
+// This function parses a lastmod date, returning the zero time if it is missing or invalid
+func parseLastMod(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range lastModLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// This function parses a sitemap, a gzip compressed sitemap is decompressed first. A urlset returns its pages and
+// a sitemap index returns the sitemaps it lists
+func ParseSitemap(content []byte) (pages []SitemapURL, sitemaps []string, err error) {
+	//Gzipped sitemaps are served as files so the transport doesn't decompress them
+	if len(content) > 2 && content[0] == 0x1f && content[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decompressing sitemap: %w", err)
+		}
+		defer gzipReader.Close()
+		content, err = io.ReadAll(io.LimitReader(gzipReader, maxSitemapSize))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decompressing sitemap: %w", err)
+		}
+	}
+
+	var document sitemapDocument
+	//Sitemaps should be UTF-8, one declaring another encoding is transcoded
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&document); err != nil {
+		return nil, nil, fmt.Errorf("error parsing sitemap: %w", err)
+	}
+	for _, entry := range document.URLs {
+		if loc := strings.TrimSpace(entry.Loc); loc != "" {
+			pages = append(pages, SitemapURL{Loc: loc, LastMod: parseLastMod(entry.LastMod)})
+		}
+	}
+	for _, entry := range document.Sitemaps {
+		if loc := strings.TrimSpace(entry.Loc); loc != "" {
+			sitemaps = append(sitemaps, loc)
+		}
+	}
+	return pages, sitemaps, nil
+}
+
+// This function reads the pages listed by the sitemaps of a site, those named by robots.txt and /sitemap.xml as a
+// site may list only some of its sitemaps in robots.txt. Sitemap index files are followed, a sitemap listed more
+// than once is read once and sitemaps that can't be read are logged and skipped
+func (c *crawler) fetchSitemaps(siteUrl *url.URL, robots *Robots) []SitemapURL {
+	queue := append([]string{}, robots.Sitemaps...)
+	queue = append(queue, (&url.URL{Scheme: siteUrl.Scheme, Host: siteUrl.Host, Path: "/sitemap.xml"}).String())
+
+	pages := []SitemapURL{}
+	seen := make(map[string]bool)
+	for len(queue) > 0 && len(seen) < maxSitemaps && c.ctx.Err() == nil {
+		sitemapUrl := queue[0]
+		queue = queue[1:]
+		//The same sitemap may be written differently in robots.txt and the sitemap index files
+		key := sitemapUrl
+		if normalized, err := NormalizeURL(sitemapUrl); err == nil {
+			key = normalized
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		content, err := c.fetchSitemap(sitemapUrl)
+		if err != nil {
+			logger.HandleError(err)
+			continue
+		}
+		found, sitemaps, err := ParseSitemap(content)
+		if err != nil {
+			logger.HandleError(fmt.Errorf("%s: %w", sitemapUrl, err))
+			continue
+		}
+		logger.HandleLog(fmt.Sprintf("sitemap %s => %d pages", sitemapUrl, len(found)))
+		pages = append(pages, found...)
+		queue = append(queue, sitemaps...)
+	}
+	return pages
+}
+
+// This function downloads a sitemap, a missing sitemap is an error the caller can skip
+func (c *crawler) fetchSitemap(sitemapUrl string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, sitemapUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating sitemap request: %w", err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+
+	if err := c.limiters.Wait(c.ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching sitemap: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sitemap %s returned %d", sitemapUrl, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSitemapSize))
+}
+
+// This function orders the pages of a re-crawl's sitemaps so pages changed since they were crawled come first,
+// most recently changed first, and returns the pages the sitemap shows are unchanged so they aren't fetched again.
+// Each loc is normalized as the pages of the index and the crawl queue are keyed by their normalized url, locs
+// that can't be normalized are dropped
+func (c *crawler) prioritiseSitemap(pages []SitemapURL) (ordered []SitemapURL, unchanged map[string]bool) {
+	unchanged = make(map[string]bool)
+	normalized := []SitemapURL{}
+	for _, page := range pages {
+		loc, err := NormalizeURL(page.Loc)
+		if err != nil {
+			continue
+		}
+		page.Loc = loc
+		normalized = append(normalized, page)
+	}
+	if c.previous == nil {
+		return normalized, unchanged
+	}
+
+	changed := []SitemapURL{}
+	rest := []SitemapURL{}
+	for _, page := range normalized {
+		meta, ok := c.previous[page.Loc]
+		switch {
+		case !ok || page.LastMod.IsZero() || meta.CrawledAt.IsZero():
+			rest = append(rest, page)
+		case page.LastMod.After(meta.CrawledAt):
+			changed = append(changed, page)
+		default:
+			unchanged[page.Loc] = true
+			rest = append(rest, page)
+		}
+	}
+	sort.SliceStable(changed, func(i, j int) bool { return changed[i].LastMod.After(changed[j].LastMod) })
+	return append(changed, rest...), unchanged
+}
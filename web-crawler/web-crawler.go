@@ -1,15 +1,18 @@
 package webcrawler
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"time"
 
 	"os"
+	"sort"
 	"strings"
 	"sync"
 
@@ -32,63 +35,414 @@ func extractDomain(rawURL string) string {
 
 // const maxURLsToCrawl = 10000
 
-func crawlPageUpdateModel(urlToCrawl string, foundUrls chan<- string, dirName string, errChan chan<- error, cachedDataMutex *sync.Mutex, cachedData *map[string]util.IndexedData, model *bm25.Model) {
-	// Start go routine, send urls to foundUrl Channel
-	//Send get request
-	logger.HandleLog(fmt.Sprintf("Initiating get request to %s", urlToCrawl))
-	resp, err := http.Get(urlToCrawl)
+// CrawlOptions are the settings a crawl is run with
+type CrawlOptions struct {
+	//URLLimit is the most pages that are crawled, a failsafe to stop the crawler from running forever
+	URLLimit int
+	//Concurrency is the number of workers fetching pages at once
+	Concurrency int
+	//RequestsPerSecond limits the requests sent to each host, 0 doesn't limit them beyond the site's crawl delay
+	RequestsPerSecond float64
+	//Timeout is how long a single request may take including reading the body
+	Timeout time.Duration
+	//Include and Exclude are url patterns, globs such as /docs/** or regular expressions starting with re:.
+	//When there are include patterns only links matching one are followed, links matching an exclude pattern never are
+	Include []string
+	Exclude []string
+	//MaxDepth is the most links a page may be from the initial URL, 0 doesn't limit it
+	MaxDepth int
+	//AllowedHosts are hosts other than the initial URL's that links may lead to, *.example.com allows its subdomains
+	AllowedHosts []string
+	//MaxRetries is how many times a request that timed out, lost its connection or got a 429 or 503 is tried again
+	MaxRetries int
+	//RetryBackoff is the wait before the first retry, it doubles with each retry up to MaxRetryDelay.
+	//A Retry-After header is honoured instead, up to MaxRetryDelay
+	RetryBackoff  time.Duration
+	MaxRetryDelay time.Duration
+	//MaxBodySize is the most bytes of a page that are downloaded, larger pages aren't indexed
+	MaxBodySize int64
+	//HTTP are the user agent, headers, credentials, cookies, proxy and TLS settings requests are sent with
+	HTTP HTTPOptions
+	//CheckpointInterval is how often the crawl state is saved to the index directory so an interrupted crawl can be resumed
+	CheckpointInterval time.Duration
+}
 
-	if err != nil {
-		errChan <- fmt.Errorf("error accessing site file: %w", err)
+// DefaultCrawlOptions are the settings used by the API and CLI unless they are overridden
+var DefaultCrawlOptions = CrawlOptions{
+	URLLimit:           10000,
+	Concurrency:        8,
+	RequestsPerSecond:  5,
+	Timeout:            30 * time.Second,
+	MaxRetries:         3,
+	RetryBackoff:       time.Second,
+	MaxRetryDelay:      30 * time.Second,
+	MaxBodySize:        10 << 20,
+	CheckpointInterval: 30 * time.Second,
+}
+
+// This function fills in the settings that aren't set with their defaults, URLLimit, RequestsPerSecond and
+// MaxRetries keep their value as zero means something for them
+func (o CrawlOptions) withDefaults() CrawlOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultCrawlOptions.Concurrency
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultCrawlOptions.Timeout
+	}
+	if o.RequestsPerSecond < 0 {
+		o.RequestsPerSecond = 0
+	}
+	if o.MaxDepth < 0 {
+		o.MaxDepth = 0
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = DefaultCrawlOptions.RetryBackoff
+	}
+	if o.MaxRetryDelay <= 0 {
+		o.MaxRetryDelay = DefaultCrawlOptions.MaxRetryDelay
+	}
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = DefaultCrawlOptions.MaxBodySize
+	}
+	if o.CheckpointInterval <= 0 {
+		o.CheckpointInterval = DefaultCrawlOptions.CheckpointInterval
+	}
+	return o
+}
+
+// This function checks the settings can be used for a crawl, the include and exclude patterns must compile
+func (o CrawlOptions) Validate() error {
+	if o.URLLimit < 0 || o.Concurrency < 0 || o.RequestsPerSecond < 0 || o.Timeout < 0 || o.MaxDepth < 0 ||
+		o.MaxRetries < 0 || o.RetryBackoff < 0 || o.MaxRetryDelay < 0 || o.MaxBodySize < 0 || o.CheckpointInterval < 0 {
+		return fmt.Errorf("crawl settings can't be negative")
+	}
+	if _, err := newURLFilter("", o); err != nil {
+		return err
+	}
+	return o.HTTP.Validate()
+}
+
+// crawlJob is a url for a worker to crawl and its depth, the number of links it is from the initial URL
+type crawlJob struct {
+	url   string
+	depth int
+}
+
+// crawlResult are the links found on a crawled page
+type crawlResult struct {
+	links []string
+	depth int
+}
+
+// crawler is the state shared by the workers of a crawl
+type crawler struct {
+	//ctx cancels the requests of the crawl when it is cancelled
+	ctx     context.Context
+	options CrawlOptions
+	client  *http.Client
+	//userAgent is sent with every request and matched against robots.txt
+	userAgent string
+	filter    *urlFilter
+	limiters  *hostLimiters
+	//robots holds the robots.txt of each host, it is only used by the crawl loop
+	robots    map[string]*Robots
+	documents bm25.DocumentWriter
+	//previous holds the validators and links of the pages of the index being re-crawled and is nil on a fresh crawl
+	previous map[string]bm25.PageMeta
+	//unchanged are the pages of a re-crawl whose sitemap lastmod is older than when they were crawled
+	unchanged map[string]bool
+	model     *bm25.Model
+	jobs      chan crawlJob
+	//results receives the links found on each crawled page, one send per job
+	results chan crawlResult
+	errChan chan error
+	//stop is closed when the crawl ends early so workers don't block on channels that are no longer read
+	stop    chan struct{}
+	workers sync.WaitGroup
+}
+
+// This function starts the fixed number of workers that fetch the urls sent to jobs
+func (c *crawler) startWorkers() {
+	for i := 0; i < c.options.Concurrency; i++ {
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			for job := range c.jobs {
+				links := c.crawlPageUpdateModel(job.url)
+				select {
+				case c.results <- crawlResult{links: links, depth: job.depth}:
+				case <-c.stop:
+				}
+			}
+		}()
+	}
+}
+
+// This function stops the workers once the pages they are fetching are indexed, urls that are still queued are dropped
+func (c *crawler) stopWorkers() {
+	close(c.stop)
+	close(c.jobs)
+	c.workers.Wait()
+}
+
+// This function returns the robots.txt of a host, fetching it the first time the host is seen and spacing the
+// requests to the host by its crawl delay
+func (c *crawler) robotsFor(siteUrl *url.URL) *Robots {
+	if robots, ok := c.robots[siteUrl.Host]; ok {
+		return robots
+	}
+	robots := fetchRobots(c.ctx, c.client, siteUrl, c.userAgent)
+	if crawlDelay := robots.CrawlDelay(c.userAgent); crawlDelay > 0 {
+		logger.HandleLog(fmt.Sprintf("%s robots.txt crawl delay: %v", siteUrl.Host, crawlDelay))
+		c.limiters.SetCrawlDelay(siteUrl.Host, crawlDelay)
+	}
+	c.robots[siteUrl.Host] = robots
+	return robots
+}
+
+// This function hands an error to the crawl loop to be logged, errors caused by cancelling the crawl are dropped
+func (c *crawler) reportError(err error) {
+	if c.ctx.Err() != nil {
 		return
 	}
-	defer resp.Body.Close()
+	select {
+	case c.errChan <- err:
+	case <-c.stop:
+		logger.HandleError(err)
+	}
+}
 
-	//Read html body
-	body, err := io.ReadAll(resp.Body)
+// This function fetches a page, indexes it and returns the links it found. The requests to each host are rate limited
+// and the page's robots directives are obeyed
+func (c *crawler) crawlPageUpdateModel(urlToCrawl string) []string {
+	model := c.model
+	//The sitemap shows the page hasn't changed since it was crawled, its stored links are followed without fetching it
+	if meta, ok := c.previous[urlToCrawl]; ok && c.unchanged[urlToCrawl] {
+		logger.HandleLog(fmt.Sprintf("%s => unchanged in sitemap", urlToCrawl))
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeUnchanged})
+		return meta.Links
+	}
+	//Send get request
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, urlToCrawl, nil)
 	if err != nil {
-		errChan <- fmt.Errorf("error reading html response body: %w", err)
-		return
+		c.reportError(fmt.Errorf("error creating request: %w", err))
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeError, Error: err.Error()})
+		return nil
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	//On a re-crawl only download the page if it changed since it was indexed
+	meta, hasMeta := c.previous[urlToCrawl]
+	if hasMeta {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	//Transient failures are retried with a backoff. The body is read as part of the request so a read that times out
+	//is retried too, it is only downloaded when the status and headers show the page may be indexed. One byte more
+	//than the limit is read to tell a page of exactly the limit from a larger one
+	var body []byte
+	resp, attempts, err := c.fetch(req, func(resp *http.Response) error {
+		contentType := mediaType(resp.Header, nil)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 || (contentType != "" && !indexedMediaTypes[contentType]) || resp.ContentLength > c.options.MaxBodySize {
+			return nil
+		}
+		var err error
+		body, err = io.ReadAll(io.LimitReader(resp.Body, c.options.MaxBodySize+1))
+		return err
+	})
+	if err != nil {
+		if c.ctx.Err() == nil {
+			c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeError, Error: err.Error(), Attempts: attempts})
+		}
+		c.reportError(fmt.Errorf("error accessing site file: %w", err))
+		return nil
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case hasMeta && resp.StatusCode == http.StatusNotModified:
+		//The page is unchanged, its stored links are followed so the pages it links to are checked too
+		logger.HandleLog(fmt.Sprintf("%s => not modified", urlToCrawl))
+		meta.CrawledAt = time.Now()
+		model.ModelLock.Lock()
+		model.Pages[urlToCrawl] = meta
+		model.ModelLock.Unlock()
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeNotModified, Status: resp.StatusCode})
+		return meta.Links
+	case c.previous != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone):
+		//The page is gone, remove it from the index being re-crawled
+		if c.removePage(urlToCrawl) {
+			logger.HandleLog(fmt.Sprintf("%s => removed (%d)", urlToCrawl, resp.StatusCode))
+			c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeRemoved, Status: resp.StatusCode})
+			return nil
+		}
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeHTTPError, Status: resp.StatusCode, Attempts: attempts})
+		return nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		//Error pages aren't indexed, a page of a re-crawl keeps its stored content as the error may not last
+		logger.HandleLog(fmt.Sprintf("%s => status %d", urlToCrawl, resp.StatusCode))
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeHTTPError, Status: resp.StatusCode, Attempts: attempts})
+		return nil
+	}
+
+	//Pages that aren't html or text, or are too large, aren't downloaded when the headers show it
+	contentType := mediaType(resp.Header, nil)
+	if contentType != "" && !indexedMediaTypes[contentType] {
+		c.skipPage(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeUnsupportedType, Status: resp.StatusCode, ContentType: contentType})
+		return nil
+	}
+	if resp.ContentLength > c.options.MaxBodySize {
+		c.skipPage(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeTooLarge, Status: resp.StatusCode, ContentType: contentType})
+		return nil
+	}
+
+	if int64(len(body)) > c.options.MaxBodySize {
+		c.skipPage(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeTooLarge, Status: resp.StatusCode, ContentType: contentType})
+		return nil
+	}
+	//Without a usable Content-Type the type is sniffed from the body
+	if contentType == "" {
+		contentType = mediaType(resp.Header, body)
+		if !indexedMediaTypes[contentType] {
+			c.skipPage(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeUnsupportedType, Status: resp.StatusCode, ContentType: contentType})
+			return nil
+		}
 	}
 
-	//get the full Url for later use
-	fullUrl, err := url.Parse(urlToCrawl)
+	//Pages in other encodings are transcoded to UTF-8 before they are tokenized
+	body, encoding, err := decodeBody(body, resp.Header.Get("Content-Type"))
 	if err != nil {
-		log.Println(err)
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeError, Status: resp.StatusCode, ContentType: contentType, Error: err.Error()})
+		c.reportError(fmt.Errorf("error decoding %s as %s: %w", urlToCrawl, encoding, err))
+		return nil
+	}
+
+	//Links are resolved against the url the page was served from, a redirect may have changed it
+	fullUrl := resp.Request.URL
+
+	//A page that redirected to a login screen needs credentials, the login page isn't indexed or followed in its place
+	if isLoginRedirect(urlToCrawl, fullUrl, body) {
+		status := resp.StatusCode
+		if resp.Request.Response != nil {
+			//The status of the redirect rather than of the login page
+			status = resp.Request.Response.StatusCode
+		}
+		c.skipPage(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeLoginRedirect, Status: status, ContentType: contentType})
+		return nil
+	}
+
+	//Parse the html into the fields that are indexed separately
+	document := lexer.ParseHtmlDocument(string(body))
+	//Robots directives can come from a meta tag or the X-Robots-Tag header
+	noIndex, noFollow := headerRobotsDirectives(resp.Header, c.userAgent)
+	noIndex = noIndex || document.NoIndex
+	noFollow = noFollow || document.NoFollow
+
+	// extract the links from the file, a nofollow page's links aren't followed
+	links := []string{}
+	if !noFollow {
+		links = lexer.ParseLinks(string(body))
+	}
+	resolvedLinks := c.resolveLinks(fullUrl, links)
+
+	if noIndex {
+		//The page asked not to be indexed, a page indexed by an earlier crawl is removed
+		c.removePage(urlToCrawl)
+		logger.HandleLog(fmt.Sprintf("%s => noindex", urlToCrawl))
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeNoIndex, Status: resp.StatusCode, ContentType: contentType})
+		return resolvedLinks
+	}
+
+	//A page that is a duplicate of another url, by its canonical link or a redirect, is indexed under that url instead
+	if canonical := canonicalUrl(urlToCrawl, fullUrl, document.Canonical); canonical != "" {
+		c.removePage(urlToCrawl)
+		logger.HandleLog(fmt.Sprintf("%s => duplicate of %s", urlToCrawl, canonical))
+		c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeDuplicate, Status: resp.StatusCode, ContentType: contentType})
+		return append(resolvedLinks, canonical)
 	}
 
-	//Prse html text tokens
-	textContent := lexer.ParseHtmlTextContent(string(body))
 	//Create model of indexed data for storage
 	IndexedData := util.IndexedData{
-		URL:     urlToCrawl,
-		Content: textContent,
+		URL:         urlToCrawl,
+		Title:       document.Title,
+		Headings:    document.Headings,
+		Description: document.Description,
+		Content:     document.Body,
 	}
 
-	//Cache the data, ensure we lock the model before accessing, this is used for disk storage
-	cachedDataMutex.Lock()
-	(*cachedData)[urlToCrawl] = IndexedData
-	cachedDataMutex.Unlock()
-
-	//Update the model so that we can send progress to the end user
-	model.ModelLock.Lock()
-	model.DirLength += 1
-	model.ModelLock.Unlock()
+	//Stream the data to the segments of the index as it is crawled rather than holding every page until the end
+	if err := c.documents.Add(IndexedData); err != nil {
+		c.reportError(fmt.Errorf("error storing %s: %w", urlToCrawl, err))
+	}
 
 	//Prepare content for parsing
 	content := IndexedData.Content
 
 	fileSize := len(content)
 	logger.HandleLog(fmt.Sprintf("%s => %v", IndexedData.URL, fileSize))
-	// tf := make(bm25.TermFreq)
-	bm25.ConvertContentToModel(content, IndexedData.URL, model)
 
 	model.ModelLock.Lock()
-	model.DocCount += 1
+	_, indexed := model.TFPD[urlToCrawl]
 	model.ModelLock.Unlock()
 
-	// extract the links from the file
-	links := lexer.ParseLinks(string(body))
+	if indexed {
+		//A changed page of the index being re-crawled, its old statistics are replaced
+		bm25.UpdateDocument(IndexedData, model)
+	} else {
+		//Update the model so that we can send progress to the end user
+		model.ModelLock.Lock()
+		model.DirLength += 1
+		model.ModelLock.Unlock()
+
+		bm25.IndexDocument(IndexedData, model)
+
+		model.ModelLock.Lock()
+		model.DocCount += 1
+		model.ModelLock.Unlock()
+	}
+
+	//Keep the validators and links so the next re-crawl can skip the page if it hasn't changed
+	model.ModelLock.Lock()
+	model.Pages[urlToCrawl] = bm25.PageMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Links:        resolvedLinks,
+		CrawledAt:    time.Now(),
+	}
+	model.ModelLock.Unlock()
+	c.recordOutcome(urlToCrawl, bm25.PageOutcome{Outcome: OutcomeIndexed, Status: resp.StatusCode, ContentType: contentType, Charset: encoding})
+
+	return resolvedLinks
+}
+
+// This function removes a page from the index, it reports whether the page was indexed
+func (c *crawler) removePage(pageUrl string) bool {
+	if !bm25.RemoveDocument(pageUrl, c.model) {
+		return false
+	}
+	c.model.ModelLock.Lock()
+	c.model.DirLength -= 1
+	c.model.ModelLock.Unlock()
+	return true
+}
+
+// This function records a page that isn't indexed because of its type or size, a page indexed by an earlier crawl
+// is removed as its content changed
+func (c *crawler) skipPage(pageUrl string, outcome bm25.PageOutcome) {
+	c.removePage(pageUrl)
+	logger.HandleLog(fmt.Sprintf("%s => %s %s", pageUrl, outcome.Outcome, outcome.ContentType))
+	c.recordOutcome(pageUrl, outcome)
+}
+
+// This function resolves the links of a page against its url, links that aren't crawled are dropped
+func (c *crawler) resolveLinks(fullUrl *url.URL, links []string) []string {
+	resolvedLinks := []string{}
 
 	//Parse the links
 	for _, link := range links {
@@ -99,7 +453,7 @@ func crawlPageUpdateModel(urlToCrawl string, foundUrls chan<- string, dirName st
 		// check if the link is a relative link
 		parsedLink, err := url.Parse(link)
 		if err != nil {
-			errChan <- fmt.Errorf("error parsing link: %w", err)
+			c.reportError(fmt.Errorf("error parsing link: %w", err))
 			continue
 		}
 
@@ -109,19 +463,51 @@ func crawlPageUpdateModel(urlToCrawl string, foundUrls chan<- string, dirName st
 			link = resolvedLink.String()
 		}
 
-		foundUrls <- link
+		resolvedLinks = append(resolvedLinks, link)
+	}
+	return resolvedLinks
+}
+
+// This function crawls a domain into the model and saves the index. Cancelling ctx stops the crawl, the pages crawled
+// so far are saved as a partial index and the context's error is returned
+func CrawlDomainUpdateModel(ctx context.Context, domain string, model *bm25.Model, fileOps bm25.FileOps, options CrawlOptions) error {
+	return crawlDomain(ctx, domain, model, fileOps, options, false, nil)
+}
 
+// This function loads the existing index of the domain and crawls it again, pages are fetched with conditional
+// requests so only pages that changed are downloaded and indexed again, and pages that now return 404 are removed
+func RecrawlDomainUpdateModel(ctx context.Context, domain string, model *bm25.Model, fileOps bm25.FileOps, options CrawlOptions) error {
+	domain, err := NormalizeURL(domain)
+	if err != nil {
+		return err
+	}
+	fullUrl, err := url.Parse(domain)
+	if err != nil {
+		return err
 	}
 
+	//The index is loaded into a separate model so the model in use is left as it was when it can't be loaded
+	loaded := bm25.NewEmptyModel()
+	if err := bm25.LoadCachedGobToModel(path.Join("indexes", fullUrl.Host), loaded); err != nil {
+		return err
+	}
+	bm25.ReplaceModel(model, loaded)
+
+	return crawlDomain(ctx, domain, model, fileOps, options, true, nil)
 }
 
-func CrawlDomainUpdateModel(domain string, model *bm25.Model, fileOps bm25.FileOps, urlLimit int) {
+// This function crawls a domain into a new generation of its index, or continues the generation of an interrupted
+// crawl from its checkpoint when resume is set
+func crawlDomain(ctx context.Context, domain string, model *bm25.Model, fileOps bm25.FileOps, options CrawlOptions, recrawl bool, resume *resumeState) error {
+	options = options.withDefaults()
+	//Links are compared in their normalized form so the initial URL is too
+	if normalized, err := NormalizeURL(domain); err == nil {
+		domain = normalized
+	}
 	logger.HandleLog(fmt.Sprintf("crawling domain: %s", domain))
 	//Start timer for benchmarking
 	start := time.Now()
-	//Initiate data models
-	cachedData := make(map[string]util.IndexedData)
-	//Keep a track of Visited urls
+	//Keep a track of Visited urls, the maps are only used by the crawl loop
 	visited := make(map[string]bool)
 
 	//These two maps are used to store the url and the file name for later mapping to the user.
@@ -129,165 +515,431 @@ func CrawlDomainUpdateModel(domain string, model *bm25.Model, fileOps bm25.FileO
 	urlFiles := make(map[string]string)
 	reverseUrlFiles := make(map[string]string)
 
-	//Mutexes for each shared data structure
-	cachedDataMutex := sync.Mutex{}
-	visitedMutex := sync.Mutex{}
-	urlsMutex := sync.Mutex{}
-	reverseUrlsMutex := sync.Mutex{}
-
 	//Create a directory for the domain in the indexes folder
 	fullUrl, err := url.Parse(domain)
 	if err != nil {
 		log.Println(err)
 	}
 	dirName := fmt.Sprint("indexes/" + fullUrl.Host)
-	err = fileOps.MkdirAll(dirName, os.ModePerm)
+
+	//Crawling without the configured proxy, TLS settings or credentials could send requests where they shouldn't go,
+	//so a client that can't be created stops the crawl before anything is written
+	client, err := newHTTPClient(options, fullUrl.Host)
+	if err != nil {
+		return fmt.Errorf("error creating http client: %w", err)
+	}
+
+	//On a re-crawl the pages of the loaded index are the starting point
+	var previous map[string]bm25.PageMeta
+	sourceDir := ""
+	if recrawl && resume == nil {
+		//The generation that was loaded, kept in checkpoints so a resumed crawl can copy its unchanged pages
+		if loadedDir, err := bm25.ResolveIndexDir(dirName); err == nil {
+			sourceDir = loadedDir
+		}
+
+		//Pages indexed before urls were normalized are removed, they are crawled again under their normalized url
+		model.ModelLock.Lock()
+		stale := []string{}
+		for pageUrl := range model.TFPD {
+			if normalized, err := NormalizeURL(pageUrl); err != nil || normalized != pageUrl {
+				stale = append(stale, pageUrl)
+			}
+		}
+		model.ModelLock.Unlock()
+		for _, pageUrl := range stale {
+			if bm25.RemoveDocument(pageUrl, model) {
+				model.ModelLock.Lock()
+				model.DirLength -= 1
+				model.ModelLock.Unlock()
+			}
+		}
+
+		previous = make(map[string]bm25.PageMeta)
+		model.ModelLock.Lock()
+		for pageUrl, meta := range model.Pages {
+			previous[pageUrl] = meta
+		}
+		for pageUrl, fileName := range model.UrlFiles {
+			urlFiles[pageUrl] = fileName
+		}
+		for fileName, pageUrl := range model.ReverseUrlFiles {
+			reverseUrlFiles[fileName] = pageUrl
+		}
+		model.ModelLock.Unlock()
+	}
+
+	//Each crawl writes a new generation of the index, it only replaces the current one once every file is written
+	generation := bm25.NewGeneration()
+	//queue holds the urls waiting for a worker, active counts the pages being crawled
+	queue := []crawlJob{}
+	active := 0
+	limitReached := false
+	unchanged := map[string]bool{}
+	//A resumed crawl continues the generation and state of its checkpoint
+	if resume != nil {
+		checkpoint := resume.checkpoint
+		generation = resume.generation
+		sourceDir = checkpoint.SourceDir
+		visited = checkpoint.Visited
+		urlFiles = checkpoint.UrlFiles
+		reverseUrlFiles = checkpoint.ReverseUrlFiles
+		previous = checkpoint.Previous
+		unchanged = checkpoint.Unchanged
+		limitReached = checkpoint.LimitReached
+		//gob leaves maps that were empty when encoded as nil
+		if visited == nil {
+			visited = make(map[string]bool)
+		}
+		if urlFiles == nil {
+			urlFiles = make(map[string]string)
+			reverseUrlFiles = make(map[string]string)
+		}
+		if recrawl && previous == nil {
+			previous = make(map[string]bm25.PageMeta)
+		}
+		for _, job := range checkpoint.Queue {
+			queue = append(queue, crawlJob{url: job.URL, depth: job.Depth})
+		}
+		logger.HandleLog(fmt.Sprintf("resuming crawl from checkpoint of %s: %d pages queued", checkpoint.CreatedAt.Format(time.RFC3339), len(queue)))
+	}
+	generationDir := path.Join(dirName, generation)
+	err = fileOps.MkdirAll(generationDir, os.ModePerm)
 
 	if err != nil {
 		log.Println(err)
 		log.Fatal(err)
 	}
+	documents, err := fileOps.CreateDocumentWriter(generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	//Update the model name for the user
+	//Update the model name for the user, the report of an earlier crawl is replaced unless this one is resumed.
+	//The pages crawled are read from the document writer until the generation is committed
 	model.ModelLock.Lock()
 	model.Name = fullUrl.Host
+	model.DocWriter = documents
+	if resume == nil {
+		model.Outcomes = make(map[string]bm25.PageOutcome)
+	}
 	model.ModelLock.Unlock()
 
-	// Use a buffered channel to store found URLs
-	foundUrls := make(chan string, 100)
-	errChan := make(chan error, 100)
+	filter, err := newURLFilter(fullUrl.Host, options)
+	if err != nil {
+		//The API and CLI validate the options first, an invalid pattern here only follows the initial URL's host
+		logger.HandleError(err)
+		filter = &urlFilter{hosts: []string{fullUrl.Host}}
+	}
 
-	// Use a WaitGroup to track the number of active goroutines
-	var wg sync.WaitGroup
+	c := &crawler{
+		ctx:       ctx,
+		options:   options,
+		client:    client,
+		userAgent: options.HTTP.userAgent(),
+		filter:    filter,
+		limiters:  newHostLimiters(options.RequestsPerSecond),
+		robots:    make(map[string]*Robots),
+		documents: documents,
+		previous:  previous,
+		unchanged: unchanged,
+		model:     model,
+		jobs:      make(chan crawlJob),
+		results:   make(chan crawlResult),
+		errChan:   make(chan error, 100),
+		stop:      make(chan struct{}),
+	}
 
-	// Start with the initial URL
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		crawlPageUpdateModel(domain, foundUrls, dirName, errChan, &cachedDataMutex, &cachedData, model)
-	}()
+	//Fetch the site's robots.txt so disallowed pages aren't crawled and requests are spaced by its crawl delay
+	robots := c.robotsFor(fullUrl)
 
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+	//Pages only listed in the sitemaps aren't reachable through links, they seed the crawl alongside the initial URL.
+	//A resumed crawl already queued them
+	sitemapPages := []SitemapURL{}
+	if !robots.disallowAll && resume == nil {
+		sitemapPages = c.fetchSitemaps(fullUrl, robots)
+		sitemapPages, c.unchanged = c.prioritiseSitemap(sitemapPages)
+	}
+	c.startWorkers()
+
+	//skipped are the urls filtered out by the crawl options or disallowed by robots.txt, they aren't checked again
+	skipped := make(map[string]bool)
+	//This function queues a url unless it was seen before, is too deep, is filtered out by the crawl options or
+	//is disallowed by robots.txt
+	enqueue := func(newURL string, depth int) {
+		//Variants of the same url are collapsed into one page
+		newURL, err := NormalizeURL(newURL)
+		if err != nil {
+			return
+		}
+		//A page found too deep may still be reached through a shorter path, so it isn't marked as visited
+		if options.MaxDepth > 0 && depth > options.MaxDepth {
+			return
+		}
+		// If the URL has already been visited or skipped, skip it
+		if visited[newURL] || skipped[newURL] {
+			return
+		}
 
-outerLoop:
-	for {
-		//Loop through the found urls and crawl them
-		select {
-		case newURL := <-foundUrls:
-			visitedMutex.Lock()
-			numberOfVisitedURLs := len(visited)
-			if numberOfVisitedURLs >= urlLimit {
-				//If we have reached the max number of urls to crawl, we can stop the crawler, this is a failsafe for testing and to stop the crawler from running forever
-				visitedMutex.Unlock()
-				model.ModelLock.Lock()
-				model.IsComplete = true
-				model.ModelLock.Unlock()
+		urlPath, err := url.Parse(newURL)
+		if err != nil {
+			log.Println(err)
+			return
+		}
 
-				//Write the cached data to disk
-				cachedDataMutex.Lock()
-				err := fileOps.CompressAndWriteGzipFile("indexed-data.gz", cachedData, dirName)
-				if err != nil {
-					log.Fatal(err)
-				}
-				cachedDataMutex.Unlock()
-				//Write the url files to disk
-				urlsMutex.Lock()
-				err = fileOps.CompressAndWriteGzipFile("url-files.gz", urlFiles, dirName)
-				if err != nil {
-					log.Fatal(err)
-				}
-				urlsMutex.Unlock()
-				//Write the reverse url files to disk
-				reverseUrlsMutex.Lock()
-				err = fileOps.CompressAndWriteGzipFile("reverse-url-files.gz", reverseUrlFiles, dirName)
-				if err != nil {
-					log.Fatal(err)
-				}
-				reverseUrlsMutex.Unlock()
-				logger.HandleLog(fmt.Sprintf("\n%s------------------------------------\nFINISHED CRAWLING %d PAGE LIMIT REACHED\n------------------------------------%s\n", util.TerminalRed, urlLimit, util.TerminalReset))
-				break outerLoop
-			}
-			// If the URL has already been visited, skip it
-			if visited[newURL] {
-				visitedMutex.Unlock()
-				continue
-			}
+		// Check the new URL is on an allowed host and matches the include and exclude patterns
+		if !filter.allowed(urlPath) {
+			skipped[newURL] = true
+			return
+		}
 
-			// Mark the URL as visited
-			visited[newURL] = true
-			visitedMutex.Unlock()
+		//Skip pages robots.txt disallows, a page indexed by an earlier crawl is removed
+		if !c.robotsFor(urlPath).Allowed(c.userAgent, newURL) {
+			skipped[newURL] = true
+			logger.HandleLog(fmt.Sprintf("%s is disallowed by robots.txt", newURL))
+			c.removePage(newURL)
+			c.recordOutcome(newURL, bm25.PageOutcome{Outcome: OutcomeDisallowed})
+			return
+		}
 
-			// Check if the new URL has the same domain
-			if extractDomain(newURL) != extractDomain(domain) {
-				// log.Println("URL is not in the same domain: ", newURL)
-				continue
-			}
+		//Only urls that will be crawled count towards the limit, links filtered out or disallowed above don't
+		if len(visited) >= options.URLLimit {
+			//If we have reached the max number of urls to crawl no more are queued, this is a failsafe for testing and to stop the crawler from running forever
+			limitReached = true
+			return
+		}
 
-			urlPath, err := url.Parse(newURL)
-			if err != nil {
-				log.Println(err)
-			}
-			fileName := urlToName(urlPath.Path)
+		// Mark the URL as visited
+		visited[newURL] = true
 
-			//Add the url and file name to the maps
-			urlsMutex.Lock()
-			urlFiles[newURL] = fileName
-			reverseUrlFiles[fileName] = newURL
-			urlsMutex.Unlock()
+		fileName := urlToName(urlPath.Path)
+		//Pages on other hosts are named after their host too so they don't collide with the initial URL's pages
+		if urlPath.Host != fullUrl.Host {
+			fileName = strings.TrimSuffix(urlPath.Host+" > "+fileName, " > ")
+		}
 
-			//Add the url and file name to the model so that the user can access them immediately
-			reverseUrlsMutex.Lock()
-			model.ReverseUrlFiles[fileName] = newURL
-			reverseUrlsMutex.Unlock()
+		//Add the url and file name to the maps
+		urlFiles[newURL] = fileName
+		reverseUrlFiles[fileName] = newURL
 
-			model.ModelLock.Lock()
-			model.UrlFiles[newURL] = fileName
-			model.ModelLock.Unlock()
+		//Add the url and file name to the model so that the user can access them immediately
+		model.ModelLock.Lock()
+		model.UrlFiles[newURL] = fileName
+		model.ReverseUrlFiles[fileName] = newURL
+		model.ModelLock.Unlock()
 
-			wg.Add(1)
-			go func(urlToCrawl string) {
-				defer wg.Done()
-				crawlPageUpdateModel(urlToCrawl, foundUrls, dirName, errChan, &cachedDataMutex, &cachedData, model)
-			}(newURL)
-		//If there is an error, log it and continue
-		case err := <-errChan:
-			logger.HandleError(err)
-		//If the crawler is complete, write the data to disk
-		case <-done:
-			model.ModelLock.Lock()
-			model.IsComplete = true
-			model.ModelLock.Unlock()
+		queue = append(queue, crawlJob{url: newURL, depth: depth})
+	}
 
-			cachedDataMutex.Lock()
-			err := fileOps.CompressAndWriteGzipFile("indexed-data.gz", cachedData, dirName)
-			if err != nil {
-				log.Fatal(err)
-			}
-			cachedDataMutex.Unlock()
+	// Start with the initial URL, it is crawled whatever the include and exclude patterns as its links lead to the pages that match
+	//A resumed crawl continues with the queue of its checkpoint instead
+	if resume == nil {
+		if robots.Allowed(c.userAgent, domain) {
+			visited[domain] = true
+			queue = append(queue, crawlJob{url: domain})
+		} else {
+			logger.HandleLog(fmt.Sprintf("%s is disallowed by robots.txt", domain))
+			c.recordOutcome(domain, bm25.PageOutcome{Outcome: OutcomeDisallowed})
+		}
+	}
+	//Sitemap pages are seeds like the initial URL
+	for _, page := range sitemapPages {
+		enqueue(page.Loc, 0)
+	}
 
-			urlsMutex.Lock()
-			err = fileOps.CompressAndWriteGzipFile("url-files.gz", urlFiles, dirName)
-			if err != nil {
-				log.Fatal(err)
-			}
-			urlsMutex.Unlock()
+	//This function saves the state of the crawl so it can be resumed, it is called when no page is being crawled so
+	//every page in the index has had its links queued
+	saveCheckpoint := func() {
+		checkpoint := crawlCheckpoint{
+			Domain:          domain,
+			Options:         options,
+			Recrawl:         recrawl,
+			SourceDir:       sourceDir,
+			Visited:         visited,
+			UrlFiles:        urlFiles,
+			ReverseUrlFiles: reverseUrlFiles,
+			Previous:        previous,
+			Unchanged:       c.unchanged,
+			LimitReached:    limitReached,
+		}
+		for _, job := range queue {
+			checkpoint.Queue = append(checkpoint.Queue, checkpointJob{URL: job.url, Depth: job.depth})
+		}
+		if err := writeCheckpoint(fileOps, generationDir, model, documents, checkpoint); err != nil {
+			logger.HandleError(fmt.Errorf("error writing crawl checkpoint: %w", err))
+		}
+	}
+	//When a checkpoint is due no more urls are handed out until the pages being crawled are indexed
+	checkpointTicker := time.NewTicker(options.CheckpointInterval)
+	defer checkpointTicker.Stop()
+	checkpointDue := false
+
+	//A page deleted from the site may no longer be linked from any page, every page of the re-crawled index is
+	//requested again so the ones that are gone return their 404 and are removed
+	if recrawl && resume == nil {
+		previousUrls := make([]string, 0, len(previous))
+		for pageUrl := range previous {
+			previousUrls = append(previousUrls, pageUrl)
+		}
+		sort.Strings(previousUrls)
+		for _, pageUrl := range previousUrls {
+			enqueue(pageUrl, 0)
+		}
+	}
 
-			reverseUrlsMutex.Lock()
-			err = fileOps.CompressAndWriteGzipFile("reverse-url-files.gz", reverseUrlFiles, dirName)
-			if err != nil {
-				log.Fatal(err)
+	for {
+		//The crawl is complete once nothing is queued or being crawled, write the data to disk
+		if len(queue) == 0 && active == 0 && ctx.Err() == nil {
+			c.stopWorkers()
+			saveGeneration(domain, options, dirName, generation, model, fileOps, documents, urlFiles, reverseUrlFiles, false)
+			logger.HandleLog(fmt.Sprintf("crawl outcomes: %v", Report(model).Counts))
+			if limitReached {
+				logger.HandleLog(fmt.Sprintf("\n%s------------------------------------\nFINISHED CRAWLING %d PAGE LIMIT REACHED\n------------------------------------%s\n", util.TerminalRed, options.URLLimit, util.TerminalReset))
+				return nil
 			}
-			reverseUrlsMutex.Unlock()
 			elapsed := time.Since(start)
 			logger.HandleLog(fmt.Sprintf("\n%s------------------------------------\nFINISHED CRAWLING  %v in %dMs\n------------------------------------%s\n", util.TerminalGreen, fullUrl.Host, elapsed.Milliseconds(), util.TerminalReset))
-			return
+			return nil
+		}
+
+		if checkpointDue && active == 0 {
+			saveCheckpoint()
+			checkpointDue = false
+		}
+
+		//Only offer the next url to the workers when there is one
+		var jobs chan<- crawlJob
+		var next crawlJob
+		if len(queue) > 0 && !checkpointDue {
+			jobs = c.jobs
+			next = queue[0]
+		}
+
+		select {
+		case jobs <- next:
+			queue = queue[1:]
+			active++
+		case result := <-c.results:
+			active--
+			//Loop through the found urls and queue them, they are one link deeper than the page they were found on
+			for _, newURL := range result.links {
+				enqueue(newURL, result.depth+1)
+			}
+		//If there is an error, log it and continue
+		case err := <-c.errChan:
+			logger.HandleError(err)
+		case <-checkpointTicker.C:
+			checkpointDue = true
+		//If the crawl is cancelled, wait for the pages being indexed and save what was crawled so far
+		case <-ctx.Done():
+			c.stopWorkers()
+			saveGeneration(domain, options, dirName, generation, model, fileOps, documents, urlFiles, reverseUrlFiles, true)
+			model.ModelLock.Lock()
+			docCount := model.DocCount
+			model.ModelLock.Unlock()
+			logger.HandleLog(fmt.Sprintf("\n%s------------------------------------\nCRAWL CANCELLED, SAVED %d PAGES OF %v\n------------------------------------%s\n", util.TerminalRed, docCount, fullUrl.Host, util.TerminalReset))
+			return ctx.Err()
+		}
+	}
+}
+
+// This function writes the crawled index to a new generation and makes it the current one, it is called once the
+// workers have stopped. partial marks the index of a crawl that was cancelled
+func saveGeneration(domain string, options CrawlOptions, dirName string, generation string, model *bm25.Model, fileOps bm25.FileOps, documents bm25.DocumentWriter, urlFiles map[string]string, reverseUrlFiles map[string]string, partial bool) {
+	generationDir := path.Join(dirName, generation)
+
+	model.ModelLock.Lock()
+	model.IsComplete = true
+	ranking := model.Ranking
+	outcomes := make(map[string]bm25.PageOutcome)
+	for pageUrl, outcome := range model.Outcomes {
+		outcomes[pageUrl] = outcome
+	}
+	//Only pages that are still indexed are saved, pages removed by a re-crawl are dropped
+	for pageUrl, fileName := range urlFiles {
+		if _, ok := model.TFPD[pageUrl]; !ok {
+			delete(urlFiles, pageUrl)
+			delete(reverseUrlFiles, fileName)
 		}
 	}
+	model.ModelLock.Unlock()
+
+	//Unchanged pages of a re-crawl weren't downloaded again, their stored content is copied to the new generation
+	err := bm25.CarryOverDocuments(model, documents)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Close the last segment of stored documents
+	err = documents.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Write the computed index so loading it doesn't tokenize every page again
+	manifest, err := bm25.WriteIndex(model, fileOps, generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Write the url files to disk
+	err = fileOps.CompressAndWriteGzipFile(bm25.UrlFilesFileName, urlFiles, generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Write the reverse url files to disk
+	err = fileOps.CompressAndWriteGzipFile(bm25.ReverseUrlFilesFileName, reverseUrlFiles, generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Write the ranking configuration so the index is ranked the same way when it is loaded
+	err = fileOps.WriteJSONFile(bm25.RankingFileName, ranking, generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Write what happened to each url so the crawl can be reported on, and the urls that failed after being retried
+	err = fileOps.WriteJSONFile(bm25.CrawlReportFileName, outcomes, generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = fileOps.WriteJSONFile(bm25.FailedURLsFileName, FailedURLs(model), generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//The crawl is finished so it can't be resumed
+	err = fileOps.RemoveFile(CheckpointFileName, generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Write the manifest last so it only exists once every file it checksums is complete
+	manifest.CreatedAt = time.Now()
+	manifest.SourceURL = domain
+	manifest.Partial = partial
+	manifest.Crawl = bm25.CrawlSettings{
+		URLLimit:          options.URLLimit,
+		Concurrency:       options.Concurrency,
+		RequestsPerSecond: options.RequestsPerSecond,
+		Timeout:           options.Timeout.String(),
+		Include:           options.Include,
+		Exclude:           options.Exclude,
+		MaxDepth:          options.MaxDepth,
+		AllowedHosts:      options.AllowedHosts,
+	}
+	err = fileOps.WriteManifest(manifest, generationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Switch readers over to the new generation in a single rename
+	err = fileOps.CommitGeneration(dirName, generation)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	//Stored documents are read from the new generation from now on, the one they were loaded from may be removed
+	store, err := bm25.OpenSegmentStore(generationDir)
+	model.ModelLock.Lock()
+	model.DocWriter = nil
+	if err == nil {
+		model.DocStore = store
+	}
+	model.ModelLock.Unlock()
 }
 
 // Convert the url to a formatted name
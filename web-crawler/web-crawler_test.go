@@ -1,15 +1,47 @@
 package webcrawler
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/deanrtaylor1/gosearch/bm25"
+	"github.com/deanrtaylor1/gosearch/query"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
 )
 
+// This function runs the rest of the test in a temporary directory, crawls write their index to ./indexes
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
 func TestShouldIgnoreLink(t *testing.T) {
 	cases := []struct {
 		link string
@@ -86,7 +118,7 @@ func TestCrawlDomainUpdateModel(t *testing.T) {
 	done := make(chan struct{})
 
 	// Crawl the test server
-	go CrawlDomainUpdateModel(ts.URL, model, bm25.FileOpsNoOp{}, 10)
+	go CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 10})
 	go waitForModelCompletion(model, done)
 	<-done
 
@@ -97,7 +129,7 @@ func TestCrawlDomainUpdateModel(t *testing.T) {
 	// Reset the model and crawl with a different limit
 	bm25.ResetModel(model)
 	//Because the links can not actually be crawled, we expect that only the original page will be added to the model and it will break from the loop immediately
-	go CrawlDomainUpdateModel(ts.URL, model, bm25.FileOpsNoOp{}, 0)
+	go CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 0})
 	go waitForModelCompletion(model, done)
 	<-done
 	if model.DocCount != 1 {
@@ -120,3 +152,1296 @@ func waitForModelCompletion(model *bm25.Model, done chan<- struct{}) {
 	}
 	done <- struct{}{}
 }
+
+func TestRecrawlDomainUpdateModel(t *testing.T) {
+	chdirTemp(t)
+
+	type page struct {
+		etag string
+		body string
+	}
+	var mutex sync.Mutex
+	pages := map[string]page{
+		"/":          {etag: `"root-1"`, body: `<html><body><a href="/promises">one</a><a href="/callbacks">two</a></body></html>`},
+		"/promises":  {etag: `"promises-1"`, body: `<html><head><title>Promises</title></head><body>A promise is returned</body></html>`},
+		"/callbacks": {etag: `"callbacks-1"`, body: `<html><head><title>Callbacks</title></head><body>Callback hell</body></html>`},
+	}
+	downloads := make(map[string]int)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		p, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == p.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads[r.URL.Path]++
+		w.Header().Set("ETag", p.etag)
+		_, err := io.WriteString(w, p.body)
+		if err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10})
+	if model.DocCount != 3 || model.DF["callback"] == 0 {
+		t.Fatalf("Expected 3 documents including callbacks, got %d", model.DocCount)
+	}
+
+	//The promises page changes and the callbacks page is deleted
+	mutex.Lock()
+	pages["/promises"] = page{etag: `"promises-2"`, body: `<html><head><title>Promises</title></head><body>Promise chaining</body></html>`}
+	delete(pages, "/callbacks")
+	downloads = make(map[string]int)
+	mutex.Unlock()
+
+	model = bm25.NewEmptyModel()
+	if err := RecrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10}); err != nil {
+		t.Fatalf("RecrawlDomainUpdateModel() error: %v", err)
+	}
+
+	if downloads["/"] != 0 || downloads["/promises"] != 1 {
+		t.Errorf("Re-crawl downloaded %v, want only the changed page", downloads)
+	}
+	if model.DocCount != 2 {
+		t.Errorf("Expected 2 documents after the re-crawl, got %d", model.DocCount)
+	}
+	if _, ok := model.DF["callback"]; ok {
+		t.Errorf("DF[callback] == %d, want the deleted page's terms removed", model.DF["callback"])
+	}
+	if model.DF["chain"] != 1 || model.DF["promis"] != 1 {
+		t.Errorf("DF == %v, want the changed page indexed once", model.DF)
+	}
+
+	//The re-crawled index is saved with the unchanged page's content
+	loaded := bm25.NewEmptyModel()
+	if err := bm25.LoadCachedGobToModel("indexes/"+extractDomain(ts.URL), loaded); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+	if loaded.DocCount != 2 || loaded.DocStore == nil || loaded.DocStore.Len() != 2 {
+		t.Errorf("Saved re-crawl has %d documents, want 2 with their content", loaded.DocCount)
+	}
+	if _, ok := loaded.UrlFiles[ts.URL+"/callbacks"]; ok {
+		t.Errorf("Saved re-crawl still maps the deleted page")
+	}
+
+	//The root stops linking the promises page which is then deleted, it is still requested and removed
+	mutex.Lock()
+	pages["/"] = page{etag: `"root-2"`, body: `<html><body>Nothing linked here</body></html>`}
+	delete(pages, "/promises")
+	mutex.Unlock()
+
+	if err := RecrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10}); err != nil {
+		t.Fatalf("RecrawlDomainUpdateModel() error: %v", err)
+	}
+	if model.DocCount != 1 {
+		t.Errorf("Expected 1 document after the unlinked page was deleted, got %d", model.DocCount)
+	}
+	if _, ok := model.DF["chain"]; ok {
+		t.Errorf("DF[chain] == %d, want the unlinked deleted page's terms removed", model.DF["chain"])
+	}
+
+	//An index that can't be loaded leaves the model in use as it was
+	if err := RecrawlDomainUpdateModel(context.Background(), "http://missing.example", model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10}); err == nil {
+		t.Errorf("RecrawlDomainUpdateModel() of a domain without an index returned no error")
+	}
+	if model.DocCount != 1 || model.DF["link"] != 1 {
+		t.Errorf("Failed re-crawl changed the model to %d documents, want it untouched", model.DocCount)
+	}
+}
+
+func TestCrawlStreamsDocuments(t *testing.T) {
+	chdirTemp(t)
+
+	pages := map[string]string{
+		"/":          `<html><body><a href="/promises">one</a><a href="/callbacks">two</a></body></html>`,
+		"/promises":  `<html><head><title>Promises</title></head><body>A promise is returned</body></html>`,
+		"/callbacks": `<html><head><title>Callbacks</title></head><body>Callback hell</body></html>`,
+	}
+	//Each page is searched while the crawl is still running
+	var model *bm25.Model
+	duringCrawl := make(map[string]string)
+	var mutex sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/callbacks" {
+			results := []bm25.ResultsMap{{Path: "http://" + r.Host + "/promises"}}
+			bm25.AddSnippets(model, results, query.Term{Value: "promis"})
+			mutex.Lock()
+			if len(results[0].Snippets) > 0 {
+				duringCrawl["/promises"] = results[0].Snippets[0].Text
+			}
+			mutex.Unlock()
+		}
+		io.WriteString(w, body)
+	}))
+	defer ts.Close()
+
+	model = bm25.NewEmptyModel()
+	//The callbacks page is crawled after the promises page was indexed
+	if err := CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10, Concurrency: 1}); err != nil {
+		t.Fatalf("CrawlDomainUpdateModel() error: %v", err)
+	}
+	if model.DocCount != 3 {
+		t.Fatalf("Expected 3 documents, got %d", model.DocCount)
+	}
+	if len(model.Documents) != 0 || model.DocWriter != nil || model.DocStore == nil || model.DocStore.Len() != 3 {
+		t.Errorf("Crawl kept %d documents in memory, want them read from the segments", len(model.Documents))
+	}
+	mutex.Lock()
+	if duringCrawl["/promises"] != "A promise is returned" {
+		t.Errorf("Snippet during the crawl == %q, want it read from the document writer", duringCrawl["/promises"])
+	}
+	mutex.Unlock()
+
+	results := []bm25.ResultsMap{{Path: ts.URL + "/callbacks"}}
+	bm25.AddSnippets(model, results, query.Term{Value: "callback"})
+	if len(results) != 1 || len(results[0].Snippets) != 1 || results[0].Snippets[0].Text != "Callback hell" {
+		t.Errorf("AddSnippets() after the crawl == %#v, want the content read from the segments", results[0].Snippets)
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	robots := ParseRobots(`
+# Comments and unknown lines are ignored
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.php$
+Crawl-delay: 2
+
+User-agent: GoSearch
+User-agent: otherbot
+Disallow: /search
+Allow: /search/about
+Disallow: /tmp/
+
+Sitemap: https://example.com/sitemap.xml
+`)
+
+	testCases := []struct {
+		name      string
+		userAgent string
+		url       string
+		expected  bool
+	}{
+		{name: "Allowed by default", userAgent: "randombot/1.0", url: "https://example.com/docs", expected: true},
+		{name: "Disallowed prefix", userAgent: "randombot/1.0", url: "https://example.com/private/page", expected: false},
+		{name: "Longer allow wins", userAgent: "randombot/1.0", url: "https://example.com/private/public/page", expected: true},
+		{name: "Wildcard and anchor", userAgent: "randombot/1.0", url: "https://example.com/a/index.php", expected: false},
+		{name: "Anchor doesn't match a longer path", userAgent: "randombot/1.0", url: "https://example.com/a/index.php?q=1", expected: true},
+		{name: "Named group replaces *", userAgent: DefaultUserAgent, url: "https://example.com/private/page", expected: true},
+		{name: "Named group rule", userAgent: DefaultUserAgent, url: "https://example.com/search?q=go", expected: false},
+		{name: "Named group allow", userAgent: DefaultUserAgent, url: "https://example.com/search/about", expected: true},
+		{name: "Shared group", userAgent: "OtherBot/2.0", url: "https://example.com/tmp/file", expected: false},
+		{name: "Robots.txt is always allowed", userAgent: DefaultUserAgent, url: "https://example.com/robots.txt", expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if allowed := robots.Allowed(tc.userAgent, tc.url); allowed != tc.expected {
+				t.Errorf("Allowed(%q, %q) == %v, want %v", tc.userAgent, tc.url, allowed, tc.expected)
+			}
+		})
+	}
+
+	if delay := robots.CrawlDelay("randombot/1.0"); delay != 2*time.Second {
+		t.Errorf("CrawlDelay() == %v, want 2s", delay)
+	}
+	if delay := robots.CrawlDelay(DefaultUserAgent); delay != 0 {
+		t.Errorf("CrawlDelay() == %v, want 0 for the named group", delay)
+	}
+	if len(robots.Sitemaps) != 1 || robots.Sitemaps[0] != "https://example.com/sitemap.xml" {
+		t.Errorf("Sitemaps == %v, want the listed sitemap", robots.Sitemaps)
+	}
+}
+
+func TestCrawlObeysRobots(t *testing.T) {
+	var mutex sync.Mutex
+	requested := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requested[r.URL.Path] = r.Header.Get("User-Agent")
+		mutex.Unlock()
+		var body string
+		switch r.URL.Path {
+		case "/robots.txt":
+			body = "User-agent: *\nDisallow: /private\n"
+		case "/":
+			body = `<html><body><a href="/private">a</a><a href="/noindex">b</a><a href="/nofollow">c</a><a href="/header">d</a><a href="/skipped" rel="nofollow">e</a></body></html>`
+		case "/noindex":
+			body = `<html><head><meta name="robots" content="noindex"></head><body><a href="/linked">f</a></body></html>`
+		case "/nofollow":
+			body = `<html><head><meta name="robots" content="nofollow"></head><body><a href="/unlinked">g</a></body></html>`
+		case "/header":
+			w.Header().Set("X-Robots-Tag", "gosearch: noindex")
+			body = `<html><body>header</body></html>`
+		default:
+			body = `<html><body>page</body></html>`
+		}
+		_, err := io.WriteString(w, body)
+		if err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 10})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, path := range []string{"/private", "/skipped", "/unlinked"} {
+		if _, ok := requested[path]; ok {
+			t.Errorf("%s was requested, want it skipped", path)
+		}
+	}
+	if _, ok := requested["/linked"]; !ok {
+		t.Errorf("The links of a noindex page weren't followed")
+	}
+	if requested["/"] != DefaultUserAgent {
+		t.Errorf("User-Agent == %q, want %q", requested["/"], DefaultUserAgent)
+	}
+
+	for _, path := range []string{"/noindex", "/header"} {
+		if _, ok := model.TFPD[ts.URL+path]; ok {
+			t.Errorf("%s was indexed, want it skipped", path)
+		}
+	}
+	//The root, nofollow and linked pages are indexed
+	if model.DocCount != 3 {
+		t.Errorf("Expected 3 documents in the model, got %d", model.DocCount)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(20 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.Wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 requests took %v, want at least 40ms", elapsed)
+	}
+
+	//A nil limiter doesn't wait
+	var none *rateLimiter
+	none.Wait(context.Background())
+}
+
+func TestCrawlWorkerPool(t *testing.T) {
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+		}()
+
+		switch r.URL.Path {
+		case "/":
+			body := "<html><body>"
+			for i := 0; i < 10; i++ {
+				body += fmt.Sprintf(`<a href="/page-%d">page</a>`, i)
+			}
+			io.WriteString(w, body+`<a href="/slow">slow</a></body></html>`)
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+			io.WriteString(w, `<html><body>slow</body></html>`)
+		default:
+			time.Sleep(20 * time.Millisecond)
+			io.WriteString(w, `<html><body>page</body></html>`)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 100, Concurrency: 3, Timeout: 200 * time.Millisecond})
+
+	if maxInFlight > 3 {
+		t.Errorf("%d requests were in flight at once, want at most 3", maxInFlight)
+	}
+	//The slow page times out, the root and the ten pages are indexed
+	if model.DocCount != 11 {
+		t.Errorf("Expected 11 documents in the model, got %d", model.DocCount)
+	}
+	if _, ok := model.TFPD[ts.URL+"/slow"]; ok {
+		t.Errorf("The page that timed out was indexed")
+	}
+}
+
+func TestHostLimiters(t *testing.T) {
+	limiters := newHostLimiters(50)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiters.Wait(context.Background(), "example.com")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 requests at 50 per second took %v, want at least 40ms", elapsed)
+	}
+
+	//Each host has its own limit
+	start = time.Now()
+	limiters.Wait(context.Background(), "other.example.com")
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("The first request to another host waited %v", elapsed)
+	}
+
+	//The crawl delay of a host is used when it is longer than the rate limit
+	limiters.SetCrawlDelay("slow.example.com", 100*time.Millisecond)
+	start = time.Now()
+	limiters.Wait(context.Background(), "slow.example.com")
+	limiters.Wait(context.Background(), "slow.example.com")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("2 requests with a 100ms crawl delay took %v", elapsed)
+	}
+}
+
+func TestParseSitemap(t *testing.T) {
+	urlset := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/a</loc><lastmod>2023-05-01</lastmod></url>
+  <url><loc> https://example.com/b </loc><lastmod>2023-05-01T10:30:00+02:00</lastmod></url>
+  <url><loc>https://example.com/c</loc></url>
+</urlset>`)
+	index := []byte(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://example.com/sitemap-1.xml.gz</loc></sitemap>
+</sitemapindex>`)
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(urlset)
+	gzipWriter.Close()
+
+	expectedPages := []SitemapURL{
+		{Loc: "https://example.com/a", LastMod: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{Loc: "https://example.com/b", LastMod: time.Date(2023, 5, 1, 8, 30, 0, 0, time.UTC)},
+		{Loc: "https://example.com/c"},
+	}
+
+	testCases := []struct {
+		name             string
+		content          []byte
+		expectedPages    []SitemapURL
+		expectedSitemaps []string
+	}{
+		{name: "Urlset", content: urlset, expectedPages: expectedPages},
+		{name: "Gzipped urlset", content: compressed.Bytes(), expectedPages: expectedPages},
+		{name: "Sitemap index", content: index, expectedSitemaps: []string{"https://example.com/sitemap-1.xml.gz"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pages, sitemaps, err := ParseSitemap(tc.content)
+			if err != nil {
+				t.Fatalf("ParseSitemap() error: %v", err)
+			}
+			if len(pages) != len(tc.expectedPages) {
+				t.Fatalf("Expected %d pages, got %v", len(tc.expectedPages), pages)
+			}
+			for i, page := range pages {
+				if page.Loc != tc.expectedPages[i].Loc || !page.LastMod.Equal(tc.expectedPages[i].LastMod) {
+					t.Errorf("Expected: %v, got: %v", tc.expectedPages[i], page)
+				}
+			}
+			if !reflect.DeepEqual(sitemaps, tc.expectedSitemaps) {
+				t.Errorf("Expected: %v, got: %v", tc.expectedSitemaps, sitemaps)
+			}
+		})
+	}
+
+	if _, _, err := ParseSitemap([]byte("<html><body>not a sitemap")); err == nil {
+		t.Errorf("Expected an error for a page that isn't a sitemap")
+	}
+}
+
+func TestCrawlSitemap(t *testing.T) {
+	chdirTemp(t)
+
+	var mutex sync.Mutex
+	lastMod := "2000-01-01"
+	downloads := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		downloads[r.URL.Path]++
+		switch r.URL.Path {
+		case "/robots.txt":
+			//The index is listed twice, written differently, it is only read once
+			io.WriteString(w, "User-agent: *\nDisallow:\nSitemap: http://"+r.Host+"/sitemap-index.xml\nSitemap: HTTP://"+r.Host+"/sitemap-index.xml\n")
+		case "/sitemap-index.xml":
+			io.WriteString(w, `<sitemapindex><sitemap><loc>http://`+r.Host+`/sitemap-pages.xml.gz</loc></sitemap></sitemapindex>`)
+		case "/sitemap.xml":
+			//robots.txt doesn't name /sitemap.xml but its pages are still crawled
+			io.WriteString(w, `<urlset><url><loc>http://`+r.Host+`/extra</loc></url></urlset>`)
+		case "/extra":
+			io.WriteString(w, `<html><head><title>Extra</title></head><body>Only in sitemap.xml</body></html>`)
+		case "/sitemap-pages.xml.gz":
+			gzipWriter := gzip.NewWriter(w)
+			//The loc isn't in its normalized form, it must still match the page indexed under the normalized url
+			io.WriteString(gzipWriter, `<urlset><url><loc>HTTP://`+r.Host+`/orphan/?utm_source=sitemap</loc><lastmod>`+lastMod+`</lastmod></url></urlset>`)
+			gzipWriter.Close()
+		case "/":
+			io.WriteString(w, `<html><body>home</body></html>`)
+		case "/orphan":
+			io.WriteString(w, `<html><head><title>Orphan</title></head><body>Only in the sitemap</body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10})
+	if _, ok := model.TFPD[ts.URL+"/orphan"]; !ok || model.DocCount != 3 {
+		t.Fatalf("Expected the page only listed in the sitemap to be indexed, got %d documents", model.DocCount)
+	}
+	if _, ok := model.TFPD[ts.URL+"/extra"]; !ok || downloads["/sitemap.xml"] != 1 || downloads["/sitemap-index.xml"] != 1 {
+		t.Errorf("Read /sitemap.xml %d and the index %d times, want each once with their pages indexed", downloads["/sitemap.xml"], downloads["/sitemap-index.xml"])
+	}
+
+	//The sitemap shows the orphan page hasn't changed since it was crawled, so the re-crawl doesn't fetch it
+	mutex.Lock()
+	downloads = make(map[string]int)
+	mutex.Unlock()
+	model = bm25.NewEmptyModel()
+	if err := RecrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10}); err != nil {
+		t.Fatalf("RecrawlDomainUpdateModel() error: %v", err)
+	}
+	mutex.Lock()
+	if downloads["/orphan"] != 0 {
+		t.Errorf("The unchanged page was fetched %d times", downloads["/orphan"])
+	}
+	//Once the sitemap shows it changed it is fetched again
+	downloads = make(map[string]int)
+	lastMod = time.Now().Add(time.Hour).Format(time.RFC3339)
+	mutex.Unlock()
+	model = bm25.NewEmptyModel()
+	if err := RecrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 10}); err != nil {
+		t.Fatalf("RecrawlDomainUpdateModel() error: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if downloads["/orphan"] != 1 {
+		t.Errorf("The changed page was fetched %d times, want 1", downloads["/orphan"])
+	}
+	if model.DocCount != 3 {
+		t.Errorf("Expected 3 documents after the re-crawls, got %d", model.DocCount)
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"HTTPS://JavaScript.INFO", "https://javascript.info/"},
+		{"https://javascript.info:443/promise-basics/", "https://javascript.info/promise-basics"},
+		{"http://javascript.info:80/a/./b/../c", "http://javascript.info/a/c"},
+		{"http://localhost:8080/page", "http://localhost:8080/page"},
+		{"https://javascript.info/page?utm_source=x&b=2&a=1&fbclid=abc", "https://javascript.info/page?a=1&b=2"},
+		{"https://javascript.info/page?#section", "https://javascript.info/page"},
+		{"https://javascript.info/%7Euser", "https://javascript.info/~user"},
+		{"https://javascript.info/PAGE", "https://javascript.info/PAGE"},
+	}
+
+	for _, v := range cases {
+		got, err := NormalizeURL(v.url)
+		if err != nil {
+			t.Errorf("NormalizeURL(%q) error: %v", v.url, err)
+		}
+		if got != v.want {
+			t.Errorf("NormalizeURL(%q) == %q, want %q", v.url, got, v.want)
+		}
+	}
+
+	if _, err := NormalizeURL("/relative"); err == nil {
+		t.Errorf("Expected an error for a relative url")
+	}
+}
+
+func TestCrawlCollapsesDuplicates(t *testing.T) {
+	var mutex sync.Mutex
+	downloads := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		downloads[r.URL.RequestURI()]++
+		mutex.Unlock()
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<html><body><a href="/page">a</a><a href="/page/">b</a><a href="/page?utm_source=x">c</a><a href="/PAGE">d</a><a href="/alias">e</a></body></html>`)
+		case "/page":
+			io.WriteString(w, `<html><head><title>Page</title></head><body>The page</body></html>`)
+		case "/PAGE":
+			io.WriteString(w, `<html><head><link rel="canonical" href="/page"></head><body>The page</body></html>`)
+		case "/alias":
+			http.Redirect(w, r, "/page", http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 10})
+
+	if model.DocCount != 2 {
+		t.Errorf("Expected the root and one page, got %d documents: %v", model.DocCount, model.TFPD)
+	}
+	for _, path := range []string{"/PAGE", "/alias"} {
+		if _, ok := model.TFPD[ts.URL+path]; ok {
+			t.Errorf("%s was indexed, want it collapsed into /page", path)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	//The redirect from /alias fetches /page a second time, the other variants aren't fetched at all
+	if downloads["/page/"] != 0 || downloads["/page?utm_source=x"] != 0 {
+		t.Errorf("Variants of /page were fetched separately: %v", downloads)
+	}
+}
+
+func TestURLFilter(t *testing.T) {
+	filter, err := newURLFilter("example.com", CrawlOptions{
+		Include:      []string{"/docs/**", "re:^/api/v[0-9]+/"},
+		Exclude:      []string{"/docs/*/draft-*", "/blog/tag/*"},
+		AllowedHosts: []string{"*.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("newURLFilter() error: %v", err)
+	}
+
+	cases := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/docs", true},
+		{"https://example.com/docs/intro/setup", true},
+		{"https://example.com/docs/intro/draft-1", false},
+		{"https://example.com/api/v2/users", true},
+		{"https://example.com/blog/post", false},
+		{"https://docs.example.com/docs/intro", true},
+		{"https://example.org/docs/intro", false},
+		{"https://notexample.com/docs/intro", false},
+	}
+
+	for _, v := range cases {
+		parsedURL, _ := url.Parse(v.url)
+		if got := filter.allowed(parsedURL); got != v.want {
+			t.Errorf("allowed(%q) == %v, want %v", v.url, got, v.want)
+		}
+	}
+
+	invalid := []CrawlOptions{{Include: []string{"re:("}}, {Exclude: []string{"docs/*"}}, {MaxDepth: -1}}
+	for _, options := range invalid {
+		if err := options.Validate(); err == nil {
+			t.Errorf("Validate(%+v) == nil, want an error", options)
+		}
+	}
+}
+
+func TestCrawlDepthAndHosts(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>other host</body></html>`)
+	}))
+	defer other.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<html><body><a href="/docs/one">a</a><a href="/blog/tag/go">b</a><a href="`+other.URL+`/page">c</a></body></html>`)
+		case "/docs/one":
+			io.WriteString(w, `<html><body>one <a href="/docs/two">d</a></body></html>`)
+		case "/docs/two":
+			io.WriteString(w, `<html><body>two <a href="/docs/three">e</a></body></html>`)
+		default:
+			io.WriteString(w, `<html><body>`+r.URL.Path+`</body></html>`)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{
+		URLLimit:     10,
+		Exclude:      []string{"/blog/**"},
+		MaxDepth:     2,
+		AllowedHosts: []string{extractDomain(other.URL)},
+	})
+
+	for _, page := range []string{ts.URL + "/", ts.URL + "/docs/one", ts.URL + "/docs/two", other.URL + "/page"} {
+		if _, ok := model.TFPD[page]; !ok {
+			t.Errorf("%s wasn't indexed", page)
+		}
+	}
+	for _, page := range []string{ts.URL + "/docs/three", ts.URL + "/blog/tag/go"} {
+		if _, ok := model.TFPD[page]; ok {
+			t.Errorf("%s was indexed, want it skipped", page)
+		}
+	}
+
+	//Links that are filtered out or disallowed don't count towards the url limit
+	scoped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			io.WriteString(w, "User-agent: *\nDisallow: /docs/private\n")
+		case "/":
+			io.WriteString(w, `<html><body><a href="/blog/1">1</a><a href="/blog/2">2</a><a href="/blog/3">3</a>`+
+				`<a href="/docs/private/1">4</a><a href="/docs/private/2">5</a><a href="/docs/one">6</a><a href="/docs/two">7</a></body></html>`)
+		default:
+			io.WriteString(w, `<html><body>`+r.URL.Path+`</body></html>`)
+		}
+	}))
+	defer scoped.Close()
+
+	model = bm25.NewEmptyModel()
+	CrawlDomainUpdateModel(context.Background(), scoped.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 3, Include: []string{"/docs/**"}})
+	for _, page := range []string{scoped.URL + "/", scoped.URL + "/docs/one", scoped.URL + "/docs/two"} {
+		if _, ok := model.TFPD[page]; !ok {
+			t.Errorf("%s wasn't indexed, the links skipped before it counted towards the limit", page)
+		}
+	}
+}
+
+func TestCancelCrawl(t *testing.T) {
+	chdirTemp(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" || r.URL.Path == "/sitemap.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		//Every page links to the next so the crawl doesn't finish on its own
+		var page int
+		fmt.Sscanf(r.URL.Path, "/page-%d", &page)
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprintf(w, `<html><body>page %d <a href="/page-%d">next</a></body></html>`, page, page+1)
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	job := StartCrawlJob(ts.URL, func(ctx context.Context) error {
+		return CrawlDomainUpdateModel(ctx, ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 1000, Concurrency: 2})
+	})
+	for {
+		time.Sleep(10 * time.Millisecond)
+		model.ModelLock.Lock()
+		docCount := model.DocCount
+		model.ModelLock.Unlock()
+		if docCount >= 3 {
+			break
+		}
+	}
+	if !job.Running() {
+		t.Fatalf("The crawl finished before it was cancelled")
+	}
+	if err := job.Cancel(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Cancel() == %v, want context.Canceled", err)
+	}
+	if job.Running() {
+		t.Errorf("The crawl is still running after it was cancelled")
+	}
+
+	//The pages crawled before the cancellation are saved as a consistent partial index
+	dirPath := "indexes/" + extractDomain(ts.URL)
+	if err := bm25.VerifyIndex(dirPath); err != nil {
+		t.Fatalf("VerifyIndex() error: %v", err)
+	}
+	generationDir, err := bm25.ResolveIndexDir(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := bm25.ReadManifest(generationDir)
+	if err != nil || manifest == nil || !manifest.Partial {
+		t.Fatalf("Expected a manifest marked partial, got %+v (%v)", manifest, err)
+	}
+	loaded := bm25.NewEmptyModel()
+	if err := bm25.LoadCachedGobToModel(dirPath, loaded); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+	if loaded.DocCount != model.DocCount || loaded.DocStore.Len() != model.DocCount {
+		t.Errorf("Saved %d documents with %d stored, the crawl indexed %d", loaded.DocCount, loaded.DocStore.Len(), model.DocCount)
+	}
+}
+
+// checkpointFileOps writes to disk and calls onCheckpoint after each crawl checkpoint is written
+type checkpointFileOps struct {
+	bm25.FileOpsImpl
+	onCheckpoint func(generationDir string)
+}
+
+func (f checkpointFileOps) CompressAndWriteGzipFile(filename string, data interface{}, dirName string) error {
+	if err := f.FileOpsImpl.CompressAndWriteGzipFile(filename, data, dirName); err != nil {
+		return err
+	}
+	if filename == CheckpointFileName {
+		f.onCheckpoint(dirName)
+	}
+	return nil
+}
+
+func TestResumeCrawl(t *testing.T) {
+	chdirTemp(t)
+
+	var mutex sync.Mutex
+	fetched := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" || r.URL.Path == "/sitemap.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		mutex.Lock()
+		fetched[r.URL.Path]++
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<html><body>home`)
+			for i := 1; i <= 8; i++ {
+				fmt.Fprintf(w, ` <a href="/page-%d">page %d</a>`, i, i)
+			}
+			fmt.Fprint(w, `</body></html>`)
+			return
+		}
+		fmt.Fprintf(w, `<html><body>content of %s</body></html>`, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	//Copy the generation as it is on disk after a checkpoint, then stop the crawl as if the process had been killed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	model := bm25.NewEmptyModel()
+	snapshot := t.TempDir()
+	snapshotGeneration := ""
+	checkpointed := []string{}
+	fileOps := checkpointFileOps{onCheckpoint: func(generationDir string) {
+		model.ModelLock.Lock()
+		defer model.ModelLock.Unlock()
+		if snapshotGeneration != "" || model.DocCount < 2 {
+			return
+		}
+		snapshotGeneration = path.Base(generationDir)
+		for pageUrl := range model.TFPD {
+			checkpointed = append(checkpointed, pageUrl)
+		}
+		if err := copyDir(generationDir, snapshot); err != nil {
+			t.Error(err)
+		}
+		cancel()
+	}}
+	options := CrawlOptions{URLLimit: 100, Concurrency: 1, CheckpointInterval: time.Millisecond}
+	if err := CrawlDomainUpdateModel(ctx, ts.URL, model, fileOps, options); !errors.Is(err, context.Canceled) {
+		t.Fatalf("CrawlDomainUpdateModel() == %v, want context.Canceled", err)
+	}
+	if snapshotGeneration == "" {
+		t.Fatalf("No checkpoint was written")
+	}
+
+	//Replace the index with the generation as it was at the checkpoint
+	dirPath := "indexes/" + extractDomain(ts.URL)
+	if err := os.RemoveAll("indexes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir(snapshot, path.Join(dirPath, snapshotGeneration)); err != nil {
+		t.Fatal(err)
+	}
+	if !HasCheckpoint(ts.URL) {
+		t.Fatalf("HasCheckpoint() == false after an interrupted crawl")
+	}
+
+	resumed := bm25.NewEmptyModel()
+	if err := ResumeCrawl(context.Background(), ts.URL, resumed, bm25.FileOpsImpl{}, HTTPOptions{}); err != nil {
+		t.Fatalf("ResumeCrawl() error: %v", err)
+	}
+	if resumed.DocCount != 9 {
+		t.Errorf("The resumed crawl indexed %d pages, want 9", resumed.DocCount)
+	}
+	if HasCheckpoint(ts.URL) {
+		t.Errorf("HasCheckpoint() == true after the resumed crawl finished")
+	}
+	if err := ResumeCrawl(context.Background(), ts.URL, bm25.NewEmptyModel(), bm25.FileOpsImpl{}, HTTPOptions{}); !errors.Is(err, ErrNoCheckpoint) {
+		t.Errorf("ResumeCrawl() of a finished crawl == %v, want ErrNoCheckpoint", err)
+	}
+
+	//The pages indexed before the checkpoint weren't fetched again
+	for _, pageUrl := range checkpointed {
+		parsedUrl, _ := url.Parse(pageUrl)
+		if fetched[parsedUrl.Path] != 1 {
+			t.Errorf("%s was fetched %d times, want 1", parsedUrl.Path, fetched[parsedUrl.Path])
+		}
+	}
+
+	if err := bm25.VerifyIndex(dirPath); err != nil {
+		t.Fatalf("VerifyIndex() error: %v", err)
+	}
+	loaded := bm25.NewEmptyModel()
+	if err := bm25.LoadCachedGobToModel(dirPath, loaded); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+	//The initial URL isn't given a file name
+	if loaded.DocCount != 9 || loaded.DocStore.Len() != 9 || len(loaded.UrlFiles) != 8 {
+		t.Errorf("Saved %d documents with %d stored and %d url files, want 9, 9 and 8", loaded.DocCount, loaded.DocStore.Len(), len(loaded.UrlFiles))
+	}
+}
+
+// This function copies the files of a directory
+func copyDir(src string, dst string) error {
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(path.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path.Join(dst, entry.Name()), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCrawlOutcomes(t *testing.T) {
+	chdirTemp(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<html><body><a href="/ok">a</a><a href="/plain">b</a><a href="/missing">c</a><a href="/broken">d</a>`+
+				`<a href="/data">e</a><a href="/image">f</a><a href="/big">g</a><a href="/login">h</a><a href="/members">i</a></body></html>`)
+		case "/ok":
+			io.WriteString(w, `<html><body>an html page</body></html>`)
+		case "/plain":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, "a plain text page")
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<html><body>internal server error</body></html>`)
+		case "/data":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"html": "<html><body>not a page</body></html>"}`)
+		case "/image":
+			//Without a Content-Type the type is sniffed from the body
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("\x89PNG\x0D\x0A\x1A\x0A not a page"))
+		case "/big":
+			io.WriteString(w, `<html><body>`+string(bytes.Repeat([]byte("large "), 100))+`</body></html>`)
+		case "/login":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/members":
+			http.Redirect(w, r, "/sign-in?next=/members", http.StatusFound)
+		case "/sign-in":
+			io.WriteString(w, `<html><body><form><input name="user"><input type="password" name="pass"></form></body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	if err := CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, CrawlOptions{URLLimit: 100, MaxBodySize: 300}); err != nil {
+		t.Fatalf("CrawlDomainUpdateModel() error: %v", err)
+	}
+
+	cases := []struct {
+		path        string
+		outcome     string
+		status      int
+		contentType string
+	}{
+		{"/", OutcomeIndexed, 200, "text/html"},
+		{"/ok", OutcomeIndexed, 200, "text/html"},
+		{"/plain", OutcomeIndexed, 200, "text/plain"},
+		{"/missing", OutcomeHTTPError, 404, ""},
+		{"/broken", OutcomeHTTPError, 500, ""},
+		{"/login", OutcomeHTTPError, 401, ""},
+		{"/data", OutcomeUnsupportedType, 200, "application/json"},
+		{"/image", OutcomeUnsupportedType, 200, "image/png"},
+		{"/big", OutcomeTooLarge, 200, "text/html"},
+		{"/members", OutcomeLoginRedirect, 302, "text/html"},
+	}
+	for _, c := range cases {
+		pageUrl, _ := NormalizeURL(ts.URL + c.path)
+		got := model.Outcomes[pageUrl]
+		if got.Outcome != c.outcome || got.Status != c.status || got.ContentType != c.contentType {
+			t.Errorf("Outcome of %s == %+v, want %s %d %s", c.path, got, c.outcome, c.status, c.contentType)
+		}
+		_, indexed := model.TFPD[pageUrl]
+		if indexed != (c.outcome == OutcomeIndexed) {
+			t.Errorf("%s indexed == %v with outcome %s", c.path, indexed, c.outcome)
+		}
+	}
+	//The login screen /members redirected to isn't indexed or queued in its place
+	for pageUrl := range model.Outcomes {
+		if parsed, _ := url.Parse(pageUrl); parsed.Path == "/sign-in" {
+			t.Errorf("The login page was crawled with outcome %+v", model.Outcomes[pageUrl])
+		}
+	}
+	for pageUrl := range model.TFPD {
+		if parsed, _ := url.Parse(pageUrl); parsed.Path == "/sign-in" {
+			t.Errorf("The login page was indexed as %s", pageUrl)
+		}
+	}
+
+	report := Report(model, OutcomeHTTPError)
+	if report.Counts[OutcomeIndexed] != 3 || report.Counts[OutcomeHTTPError] != 3 || len(report.Outcomes) != 3 {
+		t.Errorf("Report() == %+v, want 3 indexed and the 3 http errors listed", report)
+	}
+
+	//The report is saved with the index
+	loaded := bm25.NewEmptyModel()
+	if err := bm25.LoadCachedGobToModel("indexes/"+extractDomain(ts.URL), loaded); err != nil {
+		t.Fatalf("LoadCachedGobToModel() error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Outcomes, model.Outcomes) {
+		t.Errorf("Loaded outcomes == %v, want %v", loaded.Outcomes, model.Outcomes)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	shiftJIS, _ := japanese.ShiftJIS.NewEncoder().String("<html><body>日本語のページ</body></html>")
+	latin1, _ := charmap.ISO8859_1.NewEncoder().String(`<html><head><meta charset="iso-8859-1"></head><body>café crème</body></html>`)
+	windows1252, _ := charmap.Windows1252.NewEncoder().String("<html><body>“smart quotes” café</body></html>")
+	utf16, _ := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String("<html><body>naïve</body></html>")
+	lateUtf8 := "<html><body>" + string(bytes.Repeat([]byte("a"), 2000)) + " café</body></html>"
+
+	cases := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+		encoding    string
+	}{
+		{"Content-Type charset", shiftJIS, "text/html; charset=Shift_JIS", "<html><body>日本語のページ</body></html>", "shift_jis"},
+		{"meta charset", latin1, "text/html", `<html><head><meta charset="iso-8859-1"></head><body>café crème</body></html>`, "windows-1252"},
+		{"undeclared legacy encoding", windows1252, "text/html", "<html><body>“smart quotes” café</body></html>", "windows-1252"},
+		{"utf-8 byte order mark", "\xef\xbb\xbf<html><body>café</body></html>", "text/html; charset=iso-8859-1", "<html><body>café</body></html>", "utf-8"},
+		{"utf-16 byte order mark", utf16, "text/html", "<html><body>naïve</body></html>", "utf-16le"},
+		{"undeclared utf-8 after the first 1024 bytes", lateUtf8, "text/html", lateUtf8, "utf-8"},
+	}
+	for _, c := range cases {
+		got, encoding, err := decodeBody([]byte(c.body), c.contentType)
+		if err != nil || string(got) != c.want || encoding != c.encoding {
+			t.Errorf("%s: decodeBody() == %q, %s, %v, want %q, %s", c.name, got, encoding, err, c.want, c.encoding)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"0", 0, true},
+		{"-5", 0, false},
+		{"Mon, 01 May 2023 12:00:30 GMT", 30 * time.Second, true},
+		{"Mon, 01 May 2023 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, c := range cases {
+		got, ok := parseRetryAfter(c.value, now)
+		if got != c.want || ok != c.ok {
+			t.Errorf("parseRetryAfter(%q) == %v, %v, want %v, %v", c.value, got, ok, c.want, c.ok)
+		}
+	}
+
+	c := &crawler{options: CrawlOptions{RetryBackoff: 100 * time.Millisecond, MaxRetryDelay: time.Second}}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if got := c.retryDelay(attempt, nil); got < want/2 || got > want {
+			t.Errorf("retryDelay(%d) == %v, want between %v and %v", attempt, got, want/2, want)
+		}
+	}
+	//Attempts past the point where the backoff would overflow stay at MaxRetryDelay
+	for _, attempt := range []int{40, 63, 64, 100, 1000} {
+		if got := c.retryDelay(attempt, nil); got < time.Second/2 || got > time.Second {
+			t.Errorf("retryDelay(%d) == %v, want between %v and %v", attempt, got, time.Second/2, time.Second)
+		}
+	}
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"3600"}}}
+	if got := c.retryDelay(0, resp); got != time.Second {
+		t.Errorf("retryDelay() with Retry-After: 3600 == %v, want it capped at %v", got, time.Second)
+	}
+}
+
+func TestCrawlRetries(t *testing.T) {
+	chdirTemp(t)
+
+	var mutex sync.Mutex
+	requests := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests[r.URL.Path]++
+		count := requests[r.URL.Path]
+		mutex.Unlock()
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<html><body><a href="/flaky">a</a><a href="/limited">b</a><a href="/reset">c</a><a href="/missing">d</a><a href="/stalled">e</a></body></html>`)
+		case "/flaky":
+			if count <= 2 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			io.WriteString(w, `<html><body>flaky</body></html>`)
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/reset":
+			//Drop the connection without a response the first time
+			if count == 1 {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+			io.WriteString(w, `<html><body>reset</body></html>`)
+		case "/stalled":
+			//The first time the body stops part way until the request times out
+			io.WriteString(w, `<html><body>stalled`)
+			if count == 1 {
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				return
+			}
+			io.WriteString(w, `</body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	model := bm25.NewEmptyModel()
+	options := CrawlOptions{URLLimit: 100, MaxRetries: 2, RetryBackoff: time.Millisecond, MaxRetryDelay: 10 * time.Millisecond, Timeout: 300 * time.Millisecond}
+	if err := CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsImpl{}, options); err != nil {
+		t.Fatalf("CrawlDomainUpdateModel() error: %v", err)
+	}
+
+	cases := []struct {
+		path     string
+		outcome  string
+		requests int
+	}{
+		{"/flaky", OutcomeIndexed, 3},
+		{"/limited", OutcomeHTTPError, 3},
+		{"/reset", OutcomeIndexed, 2},
+		{"/stalled", OutcomeIndexed, 2},
+		{"/missing", OutcomeHTTPError, 1},
+	}
+	for _, c := range cases {
+		pageUrl, _ := NormalizeURL(ts.URL + c.path)
+		if got := model.Outcomes[pageUrl].Outcome; got != c.outcome {
+			t.Errorf("Outcome of %s == %s, want %s", c.path, got, c.outcome)
+		}
+		if requests[c.path] != c.requests {
+			t.Errorf("%s was requested %d times, want %d", c.path, requests[c.path], c.requests)
+		}
+	}
+
+	//Only the url that still failed after its retries is listed, and saved with the index
+	limited, _ := NormalizeURL(ts.URL + "/limited")
+	want := []FailedURL{{URL: limited, PageOutcome: bm25.PageOutcome{Outcome: OutcomeHTTPError, Status: http.StatusTooManyRequests, Attempts: 3}}}
+	if failed := FailedURLs(model); !reflect.DeepEqual(failed, want) {
+		t.Errorf("FailedURLs() == %+v, want %+v", failed, want)
+	}
+	generationDir, err := bm25.ResolveIndexDir("indexes/" + extractDomain(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path.Join(generationDir, bm25.FailedURLsFileName))
+	if err != nil || !bytes.Contains(data, []byte(limited)) {
+		t.Errorf("%s == %s, %v, want the failed url", bm25.FailedURLsFileName, data, err)
+	}
+}
+
+func TestReadCookieFile(t *testing.T) {
+	dir := t.TempDir()
+	cookieFile := path.Join(dir, "cookies.txt")
+	content := "# Netscape HTTP Cookie File\n\n" +
+		".example.com\tTRUE\t/\tTRUE\t1893456000\tsession\tabc123\n" +
+		"#HttpOnly_docs.internal\tFALSE\t/docs\tFALSE\t0\ttoken\txyz\n"
+	if err := os.WriteFile(cookieFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := readCookieFile(cookieFile)
+	if err != nil {
+		t.Fatalf("readCookieFile() error: %v", err)
+	}
+	want := []fileCookie{
+		{url: &url.URL{Scheme: "https", Host: "example.com", Path: "/"}, cookie: &http.Cookie{Name: "session", Value: "abc123", Path: "/", Domain: "example.com", Secure: true, Expires: time.Unix(1893456000, 0)}},
+		{url: &url.URL{Scheme: "http", Host: "docs.internal", Path: "/docs"}, cookie: &http.Cookie{Name: "token", Value: "xyz", Path: "/docs", HttpOnly: true}},
+	}
+	if !reflect.DeepEqual(cookies, want) {
+		t.Errorf("readCookieFile() == %+v, want %+v", cookies, want)
+	}
+
+	if err := os.WriteFile(cookieFile, []byte("example.com\tTRUE\t/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCookieFile(cookieFile); err == nil {
+		t.Errorf("readCookieFile() of a line with 3 fields returned no error")
+	}
+	if err := (HTTPOptions{BasicAuthUser: "user", BearerToken: "token"}).Validate(); err == nil {
+		t.Errorf("Validate() with basic auth and a bearer token returned no error")
+	}
+	if err := (HTTPOptions{Proxy: "proxy:8080"}).Validate(); err == nil {
+		t.Errorf("Validate() with a proxy that isn't a url returned no error")
+	}
+}
+
+func TestCrawlHTTPOptions(t *testing.T) {
+	var mutex sync.Mutex
+	otherAuth := []string{}
+	otherHeaders := []string{}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		otherAuth = append(otherAuth, r.Header.Get("Authorization"))
+		otherHeaders = append(otherHeaders, r.URL.Path+" X-Team: "+r.Header.Get("X-Team"))
+		mutex.Unlock()
+		io.WriteString(w, `<html><body>other host</body></html>`)
+	}))
+	defer other.Close()
+
+	rejected := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		cookie, _ := r.Cookie("session")
+		if r.UserAgent() != "TestBot/1.0" || r.Header.Get("X-Team") != "docs" || user != "staging" || password != "secret" || cookie == nil || cookie.Value != "abc" {
+			mutex.Lock()
+			rejected = append(rejected, r.URL.Path)
+			mutex.Unlock()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/robots.txt":
+			io.WriteString(w, "User-agent: testbot\nDisallow: /private\n")
+		case "/":
+			io.WriteString(w, `<html><body><a href="/page">a</a><a href="/private">b</a><a href="`+other.URL+`/page">c</a><a href="/moved">d</a></body></html>`)
+		case "/moved":
+			http.Redirect(w, r, other.URL+"/moved", http.StatusFound)
+		default:
+			io.WriteString(w, `<html><body>`+r.URL.Path+`</body></html>`)
+		}
+	}))
+	defer ts.Close()
+
+	cookieFile := path.Join(t.TempDir(), "cookies.txt")
+	if err := os.WriteFile(cookieFile, []byte("127.0.0.1\tFALSE\t/\tFALSE\t0\tsession\tabc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := CrawlOptions{
+		URLLimit:     100,
+		AllowedHosts: []string{extractDomain(other.URL)},
+		HTTP: HTTPOptions{
+			UserAgent:         "TestBot/1.0",
+			Headers:           map[string]string{"X-Team": "docs"},
+			CookieFile:        cookieFile,
+			BasicAuthUser:     "staging",
+			BasicAuthPassword: "secret",
+		},
+	}
+	model := bm25.NewEmptyModel()
+	if err := CrawlDomainUpdateModel(context.Background(), ts.URL, model, bm25.FileOpsNoOp{}, options); err != nil {
+		t.Fatalf("CrawlDomainUpdateModel() error: %v", err)
+	}
+	if len(rejected) != 0 {
+		t.Errorf("Requests to %v were sent without the configured user agent, header, credentials or cookie", rejected)
+	}
+	//robots.txt is matched against the configured user agent
+	private, _ := NormalizeURL(ts.URL + "/private")
+	if model.Outcomes[private].Outcome != OutcomeDisallowed {
+		t.Errorf("Outcome of /private == %+v, want it disallowed for testbot", model.Outcomes[private])
+	}
+	if model.DocCount != 4 {
+		t.Errorf("DocCount == %d, want the initial URL, /page, the other host's page and the redirected page", model.DocCount)
+	}
+	//Headers and credentials aren't sent to other hosts, even when a page redirects there
+	if len(otherHeaders) < 2 {
+		t.Errorf("The other host was sent %v, want its page and the redirect crawled", otherHeaders)
+	}
+	for _, auth := range otherAuth {
+		if auth != "" {
+			t.Errorf("The other host was sent Authorization: %s", auth)
+		}
+	}
+	for _, header := range otherHeaders {
+		if !strings.HasSuffix(header, "X-Team: ") {
+			t.Errorf("The other host was sent %s", header)
+		}
+	}
+
+	//Requests are sent through the proxy
+	proxied := []string{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		proxied = append(proxied, r.URL.String())
+		mutex.Unlock()
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `<html><body>through the proxy</body></html>`)
+	}))
+	defer proxy.Close()
+	model = bm25.NewEmptyModel()
+	if err := CrawlDomainUpdateModel(context.Background(), "http://docs.internal", model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 10, HTTP: HTTPOptions{Proxy: proxy.URL}}); err != nil {
+		t.Fatalf("CrawlDomainUpdateModel() through a proxy error: %v", err)
+	}
+	if model.DocCount != 1 || len(proxied) == 0 || proxied[0] != "http://docs.internal/robots.txt" {
+		t.Errorf("Crawled %d pages with %v sent through the proxy, want docs.internal crawled through it", model.DocCount, proxied)
+	}
+
+	//A client that can't be created stops the crawl rather than crawling without its settings
+	proxied = []string{}
+	model = bm25.NewEmptyModel()
+	missing := CrawlOptions{URLLimit: 10, HTTP: HTTPOptions{Proxy: proxy.URL, CookieFile: path.Join(t.TempDir(), "missing.txt")}}
+	if err := CrawlDomainUpdateModel(context.Background(), "http://docs.internal", model, bm25.FileOpsNoOp{}, missing); err == nil {
+		t.Errorf("CrawlDomainUpdateModel() with a missing cookie file == nil, want an error")
+	}
+	if model.DocCount != 0 || len(proxied) != 0 {
+		t.Errorf("Crawl with a missing cookie file indexed %d pages and sent %v, want nothing crawled", model.DocCount, proxied)
+	}
+
+	//Self-signed certificates are only accepted when verification is skipped
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>self-signed</body></html>`)
+	}))
+	defer secure.Close()
+	for _, skipVerify := range []bool{false, true} {
+		model = bm25.NewEmptyModel()
+		CrawlDomainUpdateModel(context.Background(), secure.URL, model, bm25.FileOpsNoOp{}, CrawlOptions{URLLimit: 10, HTTP: HTTPOptions{InsecureSkipVerify: skipVerify}})
+		if indexed := model.DocCount == 1; indexed != skipVerify {
+			t.Errorf("With InsecureSkipVerify %v the self-signed site was indexed == %v", skipVerify, indexed)
+		}
+	}
+}